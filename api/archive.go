@@ -0,0 +1,176 @@
+package api
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+const mediaNdjson = "application/x-ndjson"
+
+const maxArchiveSize = 256 << 20
+
+// Streams all recipes as JSON array, or as NDJSON with one recipe per line
+// for format=ndjson
+func ExportRecipes(userId int64, w http.ResponseWriter, r *http.Request) {
+  format := r.URL.Query().Get("format")
+  if format == "" {
+    format = "json"
+  }
+  if format != "json" && format != "ndjson" {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter format, use json or ndjson")
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  if format == "ndjson" {
+    w.Header().Set("Content-Type", mediaNdjson)
+  } else {
+    w.Header().Set("Content-Type", mediaJson)
+  }
+  w.Header().Set("Content-Disposition", "attachment; filename=\"recipes." + format + "\"")
+
+  out := bufio.NewWriter(w)
+  encoder := json.NewEncoder(out)
+  first := true
+  if format == "json" {
+    out.WriteString("[")
+  }
+  err = model.ForEachRecipe(tx, func(recipe *model.Recipe) error {
+    if format == "json" && ! first {
+      out.WriteString(",")
+    }
+    first = false
+    return encoder.Encode(*recipe)
+  })
+  if err != nil {
+    // The status is sent already, the client sees a broken archive
+    log.Println(err)
+    return
+  }
+  if format == "json" {
+    out.WriteString("]\n")
+  }
+  out.Flush()
+}
+
+// Loads an archive written by ExportRecipes in one transaction, nothing is
+// stored if a recipe fails. The strategy parameter decides what happens
+// to recipes whose id exists: skip (default), overwrite or duplicate.
+func ImportRecipes(userId int64, w http.ResponseWriter, r *http.Request) {
+  strategy := r.URL.Query().Get("strategy")
+  if strategy == "" {
+    strategy = model.ImportSkip
+  }
+  if ! model.ValidImportStrategy(strategy) {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter strategy, use skip, overwrite or duplicate")
+    return
+  }
+
+  in := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxArchiveSize))
+  isArray, err := startsWithArray(in)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "can't read archive: " + err.Error())
+    return
+  }
+  decoder := json.NewDecoder(in)
+  if isArray {
+    _, err = decoder.Token()
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, "Invalid Json: " + err.Error())
+      return
+    }
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  result := model.ImportResult{}
+  for position := 1; ; position++ {
+    if isArray && ! decoder.More() {
+      break
+    }
+    recipe := &model.Recipe{}
+    err = decoder.Decode(recipe)
+    if err == io.EOF && ! isArray {
+      break
+    }
+    if err != nil {
+      tx.Rollback()
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, fmt.Sprintf("recipe %d: Invalid Json: %s", position, err.Error()))
+      return
+    }
+
+    err = recipe.Validate()
+    if err != nil {
+      tx.Rollback()
+      w.WriteHeader(http.StatusUnprocessableEntity)
+      io.WriteString(w, fmt.Sprintf("recipe %d: %s", position, err.Error()))
+      return
+    }
+
+    err = recipe.Import(tx, strategy, userId, &result)
+    if err != nil {
+      tx.Rollback()
+      if _, ok := err.(model.ValidationError); ok {
+        w.WriteHeader(http.StatusUnprocessableEntity)
+        io.WriteString(w, fmt.Sprintf("recipe %d: %s", position, err.Error()))
+        return
+      }
+      log.Println(err)
+      InternalError(w, r)
+      return
+    }
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", mediaJson)
+  json.NewEncoder(w).Encode(result)
+}
+
+// Tells a JSON array from NDJSON by the first character that is no space
+func startsWithArray(in *bufio.Reader) (bool, error) {
+  for {
+    c, err := in.ReadByte()
+    if err == io.EOF {
+      return false, nil
+    }
+    if err != nil {
+      return false, err
+    }
+    if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+      continue
+    }
+    return c == '[', in.UnreadByte()
+  }
+}
@@ -1,13 +1,27 @@
 package api
 
 import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "io/ioutil"
+  "log"
+  "mime"
   "net/http"
+  "strconv"
+  "strings"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
 )
 
 func notLoggedIn(w http.ResponseWriter) {
   w.WriteHeader(http.StatusUnauthorized)
 }
 
+func forbidden(w http.ResponseWriter) {
+  w.WriteHeader(http.StatusForbidden)
+}
+
 func NotFound(w http.ResponseWriter, r *http.Request) {
   w.WriteHeader(http.StatusNotFound)
 }
@@ -15,3 +29,271 @@ func NotFound(w http.ResponseWriter, r *http.Request) {
 func InternalError(w http.ResponseWriter, r *http.Request) {
   w.WriteHeader(http.StatusInternalServerError)
 }
+
+// Reads the page and limit query parameters, defaults to the first 25
+func pageParams(r *http.Request) (int, int) {
+  var limit int = 25
+  var page int = 1
+  params := r.URL.Query()
+
+  if v, ok := params["limit"]; ok && len(v) > 0 {
+    if overwriteLimit, err := strconv.Atoi(v[0]); err == nil && overwriteLimit > 0 && overwriteLimit < 1000 {
+      limit = overwriteLimit
+    }
+  }
+
+  if v, ok := params["page"]; ok && len(v) > 0 {
+    if overwritePage, err := strconv.Atoi(v[0]); err == nil && overwritePage > 0 {
+      page = overwritePage
+    }
+  }
+  return page, limit
+}
+
+// Cursor paging is used when the cursor parameter is set, an empty cursor
+// starts at the beginning
+func cursorParam(r *http.Request) (string, bool) {
+  v, ok := r.URL.Query()["cursor"]
+  if ! ok || len(v) == 0 {
+    return "", false
+  }
+  return v[0], true
+}
+
+// Sets the RFC 8288 Link header with first, prev, next and last page
+func setPageLinks(w http.ResponseWriter, r *http.Request, page, pages int) {
+  if pages < 1 {
+    pages = 1
+  }
+  link := func(rel string, target int) string {
+    params := r.URL.Query()
+    params.Set("page", strconv.Itoa(target))
+    return "<" + r.URL.Path + "?" + params.Encode() + ">; rel=\"" + rel + "\""
+  }
+
+  links := []string{link("first", 1)}
+  if page > 1 {
+    prev := page - 1
+    if prev > pages {
+      prev = pages
+    }
+    links = append(links, link("prev", prev))
+  }
+  if page < pages {
+    links = append(links, link("next", page + 1))
+  }
+  links = append(links, link("last", pages))
+  w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// Sets the RFC 8288 Link header with first and next cursor
+func setCursorLinks(w http.ResponseWriter, r *http.Request, next string) {
+  link := func(rel string, cursor string) string {
+    params := r.URL.Query()
+    params.Set("cursor", cursor)
+    return "<" + r.URL.Path + "?" + params.Encode() + ">; rel=\"" + rel + "\""
+  }
+
+  links := []string{link("first", "")}
+  if next != "" {
+    links = append(links, link("next", next))
+  }
+  w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+const (
+  mediaJson = "application/json"
+  mediaJsonLd = "application/ld+json"
+  mediaMarkdown = "text/markdown"
+)
+
+// Picks the offered media type the Accept header prefers, the first offer
+// if the header is missing and "" if none is acceptable. Each offer gets the
+// quality of the most specific range matching it, ties keep the offer order.
+func negotiate(r *http.Request, offers ...string) string {
+  accept := r.Header.Get("Accept")
+  if strings.TrimSpace(accept) == "" {
+    return offers[0]
+  }
+
+  qualities := make([]float64, len(offers))
+  specifics := make([]int, len(offers))
+  for idx := range specifics {
+    specifics[idx] = -1
+  }
+  for _, part := range strings.Split(accept, ",") {
+    fields := strings.Split(part, ";")
+    mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+    quality := 1.0
+    for _, param := range fields[1:] {
+      param = strings.TrimSpace(param)
+      if strings.HasPrefix(param, "q=") {
+        if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+          quality = q
+        }
+      }
+    }
+
+    for idx, offer := range offers {
+      specific := -1
+      switch {
+      case mediaRange == offer:
+        specific = 2
+      case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*")):
+        specific = 1
+      case mediaRange == "*/*":
+        specific = 0
+      }
+      if specific > specifics[idx] {
+        specifics[idx] = specific
+        qualities[idx] = quality
+      }
+    }
+  }
+
+  best := ""
+  bestQuality := 0.0
+  for idx, offer := range offers {
+    if qualities[idx] > bestQuality {
+      best, bestQuality = offer, qualities[idx]
+    }
+  }
+  return best
+}
+
+func notAcceptable(w http.ResponseWriter, offers ...string) {
+  w.WriteHeader(http.StatusNotAcceptable)
+  io.WriteString(w, "supported types: " + strings.Join(offers, ", "))
+}
+
+// Strong ETag from the version of a recipe or user
+func versionTag(version int) string {
+  return "\"" + strconv.Itoa(version) + "\""
+}
+
+// Strong ETag of one representation of a version. Each media type has its
+// own tag, the JSON one is the plain version tag If-Match is checked with.
+func mediaTag(version int, mediaType string) string {
+  if mediaType == mediaJson {
+    return versionTag(version)
+  }
+  return "\"" + strconv.Itoa(version) + "-" + mediaType[strings.Index(mediaType, "/") + 1:] + "\""
+}
+
+func matchesTag(header, tag string) bool {
+  for _, candidate := range strings.Split(header, ",") {
+    candidate = strings.TrimSpace(candidate)
+    if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+      return true
+    }
+  }
+  return false
+}
+
+// Answers 304 if If-None-Match names the current version
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+  header := r.Header.Get("If-None-Match")
+  if header == "" || ! matchesTag(header, tag) {
+    return false
+  }
+  w.Header().Set("ETag", tag)
+  w.WriteHeader(http.StatusNotModified)
+  return true
+}
+
+// Answers 412 if If-Match is set and doesn't name the current version.
+// Requests without If-Match are not checked.
+func preconditionFailed(w http.ResponseWriter, r *http.Request, tag string) bool {
+  header := r.Header.Get("If-Match")
+  if header == "" || matchesTag(header, tag) {
+    return false
+  }
+  w.Header().Set("ETag", tag)
+  w.WriteHeader(http.StatusPreconditionFailed)
+  io.WriteString(w, "changed by someone else, current version is " + tag)
+  return true
+}
+
+// Answers 412 if saving lost against a concurrent change
+func versionConflict(w http.ResponseWriter, err error) bool {
+  if err != model.ErrVersionConflict {
+    return false
+  }
+  w.WriteHeader(http.StatusPreconditionFailed)
+  io.WriteString(w, err.Error())
+  return true
+}
+
+// Reads the body of a PUT or PATCH. Call it before the write transaction
+// is opened, a slow client must not hold the write lock. PATCH bodies need
+// a merge patch or JSON patch Content-Type. Writes the error response and
+// returns false if the body can't be used.
+func readChangeBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+  if r.Method == http.MethodPatch && patchFunc(r) == nil {
+    w.Header().Set("Accept-Patch", library.MediaMergePatch + ", " + library.MediaJsonPatch)
+    w.WriteHeader(http.StatusUnsupportedMediaType)
+    io.WriteString(w, "supported types: " + library.MediaMergePatch + ", " + library.MediaJsonPatch)
+    return nil, false
+  }
+  body, err := ioutil.ReadAll(r.Body)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, err.Error())
+    return nil, false
+  }
+  return body, true
+}
+
+// Merge patch or JSON patch by Content-Type, nil for other types
+func patchFunc(r *http.Request) func(doc, patch []byte) ([]byte, error) {
+  contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  switch contentType {
+  case library.MediaMergePatch:
+    return library.MergePatch
+  case library.MediaJsonPatch:
+    return library.JsonPatch
+  }
+  return nil
+}
+
+// Makes the new state of a resource in target from a body read by
+// readChangeBody. PUT bodies are the new state, PATCH bodies are applied
+// to current. Writes the error response and returns false if the body
+// can't be used.
+func applyChange(w http.ResponseWriter, r *http.Request, body []byte, current, target interface{}) bool {
+  if r.Method != http.MethodPatch {
+    err := json.NewDecoder(bytes.NewReader(body)).Decode(target)
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, "Invalid Json: " + err.Error())
+      return false
+    }
+    return true
+  }
+
+  doc, err := json.Marshal(current)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return false
+  }
+
+  doc, err = patchFunc(r)(doc, body)
+  if err == library.ErrPatchTest {
+    w.WriteHeader(http.StatusConflict)
+    io.WriteString(w, err.Error())
+    return false
+  } else if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Invalid patch: " + err.Error())
+    return false
+  }
+
+  err = json.Unmarshal(doc, target)
+  if err != nil {
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    io.WriteString(w, "Invalid result: " + err.Error())
+    return false
+  }
+  return true
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+  "encoding/json"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "strconv"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+const maxImageUpload = 10 << 20
+
+func UploadRecipeImage(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  r.Body = http.MaxBytesReader(w, r.Body, maxImageUpload)
+  file, _, err := r.FormFile("image")
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "missing or too large multipart field image")
+    return
+  }
+  defer file.Close()
+  data, err := ioutil.ReadAll(file)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "can't read image: " + err.Error())
+    return
+  }
+
+  processed, err := library.ProcessImage(data)
+  if err == library.ErrImageTooLarge {
+    w.WriteHeader(http.StatusRequestEntityTooLarge)
+    io.WriteString(w, err.Error())
+    return
+  } else if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, err.Error())
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  recipe, err := model.GetRecipeById(tx, id)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! recipe.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  image := &model.Image{
+    Recipe: id,
+    ContentType: processed.ContentType,
+    Width: processed.Width,
+    Height: processed.Height,
+    CreatedBy: userId,
+  }
+  err = image.Create(tx)
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  err = library.ImageStorage.Save(image.StorageKey(model.ImageOriginal), data)
+  for size, sizeData := range processed.Sizes {
+    if err != nil {
+      break
+    }
+    err = library.ImageStorage.Save(image.StorageKey(size), sizeData)
+  }
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+    deleteImageFiles(image)
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Location", image.URL)
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(*image)
+}
+
+func GetRecipeImage(w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  recipeId, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  id, err := strconv.ParseInt(params["imageId"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  size := r.URL.Query().Get("size")
+  if size == "" {
+    size = model.ImageOriginal
+  } else if _, ok := model.ImageSizes[size]; ! ok && size != model.ImageOriginal {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter size")
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  image, err := model.GetImage(tx, recipeId, id)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    return
+  }
+
+  file, err := library.ImageStorage.Open(image.StorageKey(size))
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  defer file.Close()
+
+  contentType := "image/jpeg"
+  if size == model.ImageOriginal {
+    contentType = image.ContentType
+  }
+  w.Header().Set("Content-Type", contentType)
+  w.Header().Set("Cache-Control", "public, max-age=86400")
+  io.Copy(w, file)
+}
+
+func DeleteRecipeImage(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  recipeId, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  id, err := strconv.ParseInt(params["imageId"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  recipe, err := model.GetRecipeById(tx, recipeId)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  image, err := model.GetImage(tx, recipeId, id)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! recipe.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  err = image.Delete(tx)
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  deleteImageFiles(image)
+}
+
+// Removes all sizes of an image from the storage, failures are only logged
+func deleteImageFiles(image *model.Image) {
+  keys := []string{image.StorageKey(model.ImageOriginal)}
+  for size := range model.ImageSizes {
+    keys = append(keys, image.StorageKey(size))
+  }
+  for _, key := range keys {
+    err := library.ImageStorage.Delete(key)
+    if err != nil {
+      log.Println(err)
+    }
+  }
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+  "encoding/json"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "path"
+  "strings"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+const maxImportSize = 5 << 20
+
+const (
+  importPreview = "preview"
+  importCommit = "commit"
+)
+
+// Reads the document to import from the multipart field file or from the
+// raw request body, returns the file name if there is one
+func readImport(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+  r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+  if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+    file, header, err := r.FormFile("file")
+    if err != nil {
+      return nil, "", err
+    }
+    defer file.Close()
+    data, err := ioutil.ReadAll(file)
+    return data, header.Filename, err
+  }
+  data, err := ioutil.ReadAll(r.Body)
+  return data, "", err
+}
+
+// Imports a schema.org Recipe from an HTML page or JSON-LD
+func ImportSchemaRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
+  importRecipe(userId, w, r, model.ParseSchemaRecipe)
+}
+
+// Imports a Cooklang recipe, the file name is the title if the recipe has
+// none
+func ImportCooklangRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
+  importRecipe(userId, w, r, func(data []byte) (*model.Recipe, error) {
+    return model.ParseCooklang(string(data))
+  })
+}
+
+// The default mode preview only returns the parsed recipe, mode commit
+// stores it
+func importRecipe(userId int64, w http.ResponseWriter, r *http.Request, parse func([]byte) (*model.Recipe, error)) {
+  mode := r.URL.Query().Get("mode")
+  if mode == "" {
+    mode = importPreview
+  }
+  if mode != importPreview && mode != importCommit {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter mode, use preview or commit")
+    return
+  }
+
+  data, filename, err := readImport(w, r)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "can't read import: " + err.Error())
+    return
+  }
+
+  recipe, err := parse(data)
+  if err != nil {
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    io.WriteString(w, err.Error())
+    return
+  }
+  if recipe.Title == "" && filename != "" {
+    base := path.Base(strings.Replace(filename, "\\", "/", -1))
+    recipe.Title = strings.TrimSuffix(base, path.Ext(base))
+  }
+
+  err = recipe.Validate()
+  if err != nil {
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    io.WriteString(w, err.Error())
+    return
+  }
+
+  if mode == importCommit {
+    db, tx, err := library.CreateTransaction()
+    if err != nil {
+      log.Println(err)
+      InternalError(w, r)
+      return
+    }
+    defer db.Close()
+
+    recipe.CreatedBy = userId
+    recipe.UpdatedBy = userId
+    err = recipe.Create(tx)
+    if err != nil {
+      tx.Rollback()
+      if _, ok := err.(model.ValidationError); ok {
+        w.WriteHeader(http.StatusUnprocessableEntity)
+        io.WriteString(w, err.Error())
+        return
+      }
+      log.Println(err)
+      InternalError(w, r)
+      return
+    }
+
+    err = tx.Commit()
+    if err != nil {
+      tx.Rollback()
+      log.Println(err)
+      InternalError(w, r)
+      return
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*recipe)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+  "encoding/json"
+  "io"
+  "log"
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
+)
+
+var loginPolicy = model.DefaultLoginPolicy
+
+// Sets the limits for failed logins, call before serving requests
+func SetLoginPolicy(policy model.LoginPolicy) {
+  loginPolicy = policy
+}
+
+var trustedProxies []*net.IPNet
+
+// Sets the reverse proxies whose forwarding headers are believed when
+// counting failed logins per address, call before serving requests
+func SetTrustedProxies(proxies []*net.IPNet) {
+  trustedProxies = proxies
+}
+
+func trustedProxy(address string) bool {
+  ip := net.ParseIP(address)
+  if ip == nil {
+    return false
+  }
+  for _, proxy := range trustedProxies {
+    if proxy.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// The address of the client, behind trusted proxies the right-most address
+// in Forwarded or X-Forwarded-For that isn't one of them. Entries left of it
+// come from the client and can be forged.
+func clientAddress(r *http.Request) string {
+  address, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    address = r.RemoteAddr
+  }
+  if ! trustedProxy(address) {
+    return address
+  }
+
+  forwarded := forwardedAddresses(r)
+  for idx := len(forwarded) - 1; idx >= 0 && trustedProxy(address); idx-- {
+    if net.ParseIP(forwarded[idx]) == nil {
+      break
+    }
+    address = forwarded[idx]
+  }
+  return address
+}
+
+// Client addresses from the Forwarded header, X-Forwarded-For if there is
+// none, nearest proxy last
+func forwardedAddresses(r *http.Request) []string {
+  list := []string{}
+  if values := r.Header.Values("Forwarded"); len(values) > 0 {
+    for _, element := range strings.Split(strings.Join(values, ","), ",") {
+      address := ""
+      for _, pair := range strings.Split(element, ";") {
+        parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+        if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+          address = forwardedNode(strings.Trim(parts[1], "\""))
+        }
+      }
+      list = append(list, address)
+    }
+    return list
+  }
+  for _, address := range strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",") {
+    list = append(list, forwardedNode(strings.TrimSpace(address)))
+  }
+  return list
+}
+
+// Strips the port and IPv6 brackets of a forwarded node like
+// "[2001:db8::1]:4711" or "192.0.2.43:8080"
+func forwardedNode(node string) string {
+  if host, _, err := net.SplitHostPort(node); err == nil {
+    return host
+  }
+  return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+  seconds := int(math.Ceil(wait.Seconds()))
+  if seconds < 1 {
+    seconds = 1
+  }
+  w.Header().Set("Retry-After", strconv.Itoa(seconds))
+  w.WriteHeader(http.StatusTooManyRequests)
+  io.WriteString(w, "too many failed logins, retry in " + strconv.Itoa(seconds) + " seconds")
+}
+
+func ListLockouts(userId int64, w http.ResponseWriter, r *http.Request) {
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  list, err := loginPolicy.GetLockouts(tx)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(list)
+}
+
+func ClearLockout(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  found, err := model.DeleteLockout(tx, id)
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  if ! found {
+    tx.Rollback()
+    NotFound(w, r)
+    return
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+  "net"
+  "net/http"
+  "testing"
+)
+
+func TestClientAddress(t *testing.T) {
+  _, network, _ := net.ParseCIDR("10.0.0.0/8")
+  SetTrustedProxies([]*net.IPNet{network})
+  defer SetTrustedProxies(nil)
+
+  tests := []struct {
+    name string
+    remote string
+    header string
+    value string
+    want string
+  }{
+    {"direct", "192.0.2.1:4000", "", "", "192.0.2.1"},
+    {"untrusted remote ignores header", "192.0.2.1:4000", "X-Forwarded-For", "198.51.100.7", "192.0.2.1"},
+    {"trusted proxy", "10.0.0.1:4000", "X-Forwarded-For", "198.51.100.7", "198.51.100.7"},
+    {"forged entries left of the client", "10.0.0.1:4000", "X-Forwarded-For", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+    {"proxy chain", "10.0.0.1:4000", "X-Forwarded-For", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+    {"only proxies", "10.0.0.1:4000", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+    {"invalid entry", "10.0.0.1:4000", "X-Forwarded-For", "198.51.100.7, garbage", "10.0.0.1"},
+    {"trusted proxy without header", "10.0.0.1:4000", "", "", "10.0.0.1"},
+    {"forwarded", "10.0.0.1:4000", "Forwarded", "for=203.0.113.9, for=198.51.100.7;proto=https", "198.51.100.7"},
+    {"forwarded ipv6 with port", "10.0.0.1:4000", "Forwarded", "for=\"[2001:db8::1]:4711\"", "2001:db8::1"},
+    {"forwarded obfuscated", "10.0.0.1:4000", "Forwarded", "for=_hidden", "10.0.0.1"},
+  }
+
+  for _, test := range tests {
+    r, _ := http.NewRequest("POST", "/auth/login", nil)
+    r.RemoteAddr = test.remote
+    if test.header != "" {
+      r.Header.Set(test.header, test.value)
+    }
+    if got := clientAddress(r); got != test.want {
+      t.Errorf("%s: clientAddress = %q, want %q", test.name, got, test.want)
+    }
+  }
+}
@@ -1,67 +1,258 @@
 package api
 
 import (
+  "encoding/json"
+  "io"
   "strconv"
   "net/http"
   "log"
+  "time"
   "github.com/hc42/food-api/library"
   "github.com/hc42/food-api/model"
 )
 
+type tokenResponse struct {
+  AccessToken string `json:"access_token"`
+  TokenType string `json:"token_type"`
+  ExpiresIn int64 `json:"expires_in"`
+  RefreshToken string `json:"refresh_token"`
+}
+
+func createToken(user *model.User, session string, lifetime time.Duration) (string, error) {
+  return library.CreateJwtToken(strconv.FormatInt(user.ID, 10), user.Name, user.Role, session, lifetime)
+}
+
 func SetToken(user *model.User, w http.ResponseWriter) bool {
-  token, err := library.CreateJwtToken (strconv.FormatInt(user.ID, 10), user.Name)
+  token, err := createToken(user, "", library.LegacyTokenLifetime)
   if err == nil {
     w.Header().Set("Authorization", "BEARER " + token)
   }
   return err != nil
 }
 
-func RequireLogin(handler func(userId int64, w http.ResponseWriter, r *http.Request)) (func(w http.ResponseWriter, r *http.Request)) {
-  return func(w http.ResponseWriter, r *http.Request) {
+// Answers with a new access token for the session of the given refresh
+// token
+func writeTokens(w http.ResponseWriter, r *http.Request, user *model.User, stored *model.RefreshToken, refreshToken string) {
+  token, err := createToken(user, stored.Family, library.AccessTokenLifetime)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
 
-    subject, err := library.ValidateJwtAndGetSubject(r)
-    if err != nil {
-      notLoggedIn(w)
-      log.Println(err)
-      return
-    }
+  w.Header().Set("Cache-Control", "no-store")
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(tokenResponse{
+    AccessToken: token,
+    TokenType: "Bearer",
+    ExpiresIn: int64(library.AccessTokenLifetime / time.Second),
+    RefreshToken: refreshToken,
+  })
+}
 
-    id, err := strconv.ParseInt(subject, 10, 64)
-    if err != nil {
-      log.Println("JWT subject no int")
-      log.Println(err)
-      notLoggedIn(w)
-      return
+// Exchanges a refresh token for a new access and refresh token. Each
+// refresh token works once, replaying one logs out every session that
+// came from the same login.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+  var body struct {
+    RefreshToken string `json:"refresh_token"`
+  }
+
+  err := json.NewDecoder(r.Body).Decode(&body)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Invalid Json: " + err.Error())
+    return
+  }
+  if body.RefreshToken == "" {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "refresh_token is required")
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  stored, refreshToken, err := model.RotateRefreshToken(tx, body.RefreshToken)
+  if err == model.ErrRefreshTokenReuse {
+    // Keep the revocation of the family
+    log.Println("refresh token reused for user", stored.User)
+    commitErr := tx.Commit()
+    if commitErr != nil {
+      log.Println(commitErr)
     }
+    notLoggedIn(w)
+    io.WriteString(w, err.Error())
+    return
+  } else if err == model.ErrInvalidRefreshToken {
+    tx.Rollback()
+    notLoggedIn(w)
+    io.WriteString(w, err.Error())
+    return
+  } else if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  user, err := model.GetUser(tx, stored.User)
+  if err != nil && err.Error() != "sql: no rows in result set" {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if err != nil || ! user.Enabled {
+    tx.Rollback()
+    notLoggedIn(w)
+    return
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  writeTokens(w, r, user, stored, refreshToken)
+}
+
+// Revokes the access token of the request and the refresh tokens of its
+// session
+func Logout(userId int64, w http.ResponseWriter, r *http.Request) {
+  claims, err := library.ValidateJwt(r)
+  if err != nil {
+    log.Println(err)
+    notLoggedIn(w)
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
 
-    db, tx, err := library.CreateTransaction()
-    if err != nil {
-      log.Println(err)
-      InternalError(w, r)
+  if claims.ID != "" {
+    err = library.RevokeJwt(tx, claims)
+  }
+  if err == nil && claims.Session != "" {
+    err = model.RevokeRefreshFamily(tx, claims.Session)
+  }
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// Revokes all tokens of the user, every session has to log in again
+func LogoutAll(userId int64, w http.ResponseWriter, r *http.Request) {
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  user := &model.User{ID: userId}
+  err = user.RevokeTokens(tx)
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func RequireLogin(handler func(userId int64, w http.ResponseWriter, r *http.Request)) (func(w http.ResponseWriter, r *http.Request)) {
+  return func(w http.ResponseWriter, r *http.Request) {
+    user, ok := loggedInUser(w, r)
+    if ! ok {
       return
     }
 
-    user, err := model.GetUser(tx, id)
-    if err != nil && err.Error() != "sql: no rows in result set" {
-      log.Println(err)
-      InternalError(w, r)
-      db.Close()
-      return
-    } else if ! user.Enabled {
-      notLoggedIn(w)
-      db.Close()
+    // Handle logged in request
+    handler(user.ID, w, r)
+  }
+}
+
+// Like RequireLogin, but the user needs at least the given role
+func RequireRole(role string, handler func(userId int64, w http.ResponseWriter, r *http.Request)) (func(w http.ResponseWriter, r *http.Request)) {
+  return func(w http.ResponseWriter, r *http.Request) {
+    user, ok := loggedInUser(w, r)
+    if ! ok {
       return
     }
-    err = tx.Commit()
-    if err != nil {
-      log.Println(err)
-      InternalError(w, r)
-      db.Close()
+
+    if ! user.HasRole(role) {
+      forbidden(w)
       return
     }
-    db.Close()
 
     // Handle logged in request
-    handler(id, w, r)
+    handler(user.ID, w, r)
+  }
+}
+
+// Loads the enabled user of the request token, writes the error response
+// and returns false if there is none
+func loggedInUser(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+
+  subject, err := library.ValidateJwtAndGetSubject(r)
+  if err != nil {
+    notLoggedIn(w)
+    log.Println(err)
+    return nil, false
+  }
+
+  id, err := strconv.ParseInt(subject, 10, 64)
+  if err != nil {
+    log.Println("JWT subject no int")
+    log.Println(err)
+    notLoggedIn(w)
+    return nil, false
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return nil, false
+  }
+  defer db.Close()
+
+  user, err := model.GetUser(tx, id)
+  if err != nil && err.Error() != "sql: no rows in result set" {
+    log.Println(err)
+    InternalError(w, r)
+    return nil, false
+  } else if ! user.Enabled {
+    notLoggedIn(w)
+    return nil, false
+  }
+  err = tx.Commit()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return nil, false
   }
+  return user, true
 }
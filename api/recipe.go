@@ -2,6 +2,7 @@ package api
 
 import (
   "encoding/json"
+  "errors"
   "io"
   "log"
   "net/http"
@@ -11,22 +12,139 @@ import (
   "github.com/hc42/food-api/library"
 )
 
+var recipeMediaTypes = []string{mediaJson, mediaJsonLd, mediaMarkdown}
+
+func writeRecipe(w http.ResponseWriter, mediaType string, recipe *model.Recipe) {
+  w.Header().Set("Vary", "Accept")
+  switch mediaType {
+  case mediaJsonLd:
+    w.Header().Set("Content-Type", mediaJsonLd)
+    json.NewEncoder(w).Encode(recipe.SchemaOrg())
+  case mediaMarkdown:
+    w.Header().Set("Content-Type", mediaMarkdown + "; charset=utf-8")
+    io.WriteString(w, recipe.Markdown())
+  default:
+    w.Header().Set("Content-Type", mediaJson)
+    json.NewEncoder(w).Encode(*recipe)
+  }
+}
+
+// JSON-LD and Markdown only hold the recipes, paging is in the Link header
+func writeRecipeList(w http.ResponseWriter, mediaType string, list *model.RecipeListPage) {
+  w.Header().Set("Vary", "Accept")
+  switch mediaType {
+  case mediaJsonLd:
+    w.Header().Set("Content-Type", mediaJsonLd)
+    json.NewEncoder(w).Encode(model.SchemaOrgList(list.List))
+  case mediaMarkdown:
+    w.Header().Set("Content-Type", mediaMarkdown + "; charset=utf-8")
+    io.WriteString(w, model.MarkdownList(list.List))
+  default:
+    w.Header().Set("Content-Type", mediaJson)
+    json.NewEncoder(w).Encode(*list)
+  }
+}
+
 func ListRecipes(w http.ResponseWriter, r *http.Request) {
-  var limit int = 25
-  var page int = 1
+  mediaType := negotiate(r, recipeMediaTypes...)
+  if mediaType == "" {
+    notAcceptable(w, recipeMediaTypes...)
+    return
+  }
+  page, limit := pageParams(r)
+  query, err := recipeQueryParams(r)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, err.Error())
+    return
+  }
+  if _, useCursor := cursorParam(r); useCursor && query.Sort != "" && query.Sort != "id" {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "cursor paging only supports sort by id")
+    return
+  }
+  units := r.URL.Query().Get("units")
+  if ! model.ValidUnitSystem(units) {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter units, use metric, imperial or original")
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  var result *model.RecipeListPage
+  cursor, useCursor := cursorParam(r)
+  if useCursor {
+    result, err = model.GetListCursor(tx, cursor, limit, query)
+  } else {
+    result, err = model.GetListPage(tx, page, limit, query)
+  }
+  if err == model.ErrInvalidCursor {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter cursor")
+    return
+  } else if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  for idx := range result.List {
+    result.List[idx].ConvertUnits(units)
+  }
+
+  if useCursor {
+    setCursorLinks(w, r, result.NextCursor)
+  } else {
+    setPageLinks(w, r, result.Page, result.Pages)
+  }
+  writeRecipeList(w, mediaType, result)
+}
+
+// Reads sort, order, ingredient, excludeIngredient, titleStartsWith and tag
+func recipeQueryParams(r *http.Request) (*model.RecipeQuery, error) {
   params := r.URL.Query()
+  query := &model.RecipeQuery{
+    Sort: params.Get("sort"),
+    Ingredients: params["ingredient"],
+    ExcludeIngredients: params["excludeIngredient"],
+    TitlePrefix: params.Get("titleStartsWith"),
+    Tags: params["tag"],
+  }
+  if query.Sort != "" && ! model.ValidRecipeSort(query.Sort) {
+    return nil, errors.New("invalid parameter sort, use id, title, created or updated")
+  }
+  switch params.Get("order") {
+  case "", "asc":
+  case "desc":
+    query.Descending = true
+  default:
+    return nil, errors.New("invalid parameter order, use asc or desc")
+  }
+  return query, nil
+}
 
-  if v, ok := params["limit"]; ok && len(v) > 0 {
-    if overwriteLimit, err := strconv.Atoi(v[0]); err == nil && overwriteLimit > 0 && overwriteLimit < 1000 {
-      limit = overwriteLimit
-    }
+func SearchRecipes(w http.ResponseWriter, r *http.Request) {
+  if ! model.SearchEnabled {
+    w.WriteHeader(http.StatusNotImplemented)
+    io.WriteString(w, "search not available")
+    return
   }
 
-  if v, ok := params["page"]; ok && len(v) > 0 {
-    if overwritePage, err := strconv.Atoi(v[0]); err == nil && overwritePage > 0 {
-      page = overwritePage
-    }
+  query := model.SearchQuery(r.URL.Query().Get("q"))
+  if query == "" {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "missing parameter q")
+    return
   }
+  page, limit := pageParams(r)
 
   db, tx, err := library.CreateTransaction()
   if err != nil {
@@ -37,18 +155,24 @@ func ListRecipes(w http.ResponseWriter, r *http.Request) {
   defer db.Close()
   defer tx.Commit()
 
-  result, err := model.GetListPage(tx, page, limit)
+  result, err := model.SearchRecipes(tx, query, page, limit)
   if err != nil {
     log.Println(err)
     InternalError(w, r)
     return
   }
 
+  setPageLinks(w, r, result.Page, result.Pages)
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*result)
 }
 
 func GetRecipe(w http.ResponseWriter, r *http.Request) {
+  mediaType := negotiate(r, recipeMediaTypes...)
+  if mediaType == "" {
+    notAcceptable(w, recipeMediaTypes...)
+    return
+  }
   params := mux.Vars(r)
   id, err := strconv.ParseInt(params["id"], 10, 64)
   if err != nil {
@@ -73,13 +197,44 @@ func GetRecipe(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  w.Header().Set("Content-Type", "application/json")
-  json.NewEncoder(w).Encode(*recipe)
+  // A 304 varies like the full answer
+  w.Header().Set("Vary", "Accept")
+  tag := mediaTag(recipe.Version, mediaType)
+  if notModified(w, r, tag) {
+    return
+  }
+
+  if v := r.URL.Query().Get("servings"); v != "" {
+    servings, err := strconv.Atoi(v)
+    if err == nil {
+      err = recipe.Scale(servings)
+    }
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, "invalid parameter servings: " + err.Error())
+      return
+    }
+  }
+
+  err = recipe.ConvertUnits(r.URL.Query().Get("units"))
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter units, use metric, imperial or original")
+    return
+  }
+
+  w.Header().Set("ETag", tag)
+  writeRecipe(w, mediaType, recipe)
 }
 
-func DeleteRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
+func GetRecipeCooklang(w http.ResponseWriter, r *http.Request) {
   params := mux.Vars(r)
   id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
 
   db, tx, err := library.CreateTransaction()
   if err != nil {
@@ -88,6 +243,30 @@ func DeleteRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
   defer db.Close()
+  defer tx.Commit()
+
+  recipe, err := model.GetRecipeById(tx, id)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  io.WriteString(w, recipe.Cooklang())
+}
+
+func DeleteRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+
+  db, tx, err := library.CreateWriteTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
 
   recipe, err := model.GetRecipeById(tx, id)
   if err != nil {
@@ -99,9 +278,32 @@ func DeleteRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  err = recipe.Delete(tx)
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! recipe.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  if preconditionFailed(w, r, versionTag(recipe.Version)) {
+    tx.Rollback()
+    return
+  }
+
+  recipe.UpdatedBy = userId
+  err = recipe.Trash(tx)
   if err != nil {
     tx.Rollback()
+    if versionConflict(w, err) {
+      return
+    }
     log.Println(err)
     InternalError(w,r)
     return
@@ -124,6 +326,13 @@ func CreateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  err = recipe.Validate()
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, err.Error())
+    return
+  }
+
   db, tx, err := library.CreateTransaction()
   if err != nil {
     log.Println(err)
@@ -132,9 +341,16 @@ func CreateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
   }
   defer db.Close()
 
+  recipe.CreatedBy = userId
+  recipe.UpdatedBy = userId
   err = recipe.Create(tx)
   if err != nil {
     tx.Rollback()
+    if _, ok := err.(model.ValidationError); ok {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, err.Error())
+      return
+    }
     log.Println(err)
     InternalError(w, r)
     return
@@ -148,6 +364,7 @@ func CreateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  w.Header().Set("ETag", versionTag(recipe.Version))
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*recipe)
 }
@@ -162,16 +379,12 @@ func UpdateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  recipe := &model.Recipe{}
-  err = json.NewDecoder(r.Body).Decode(recipe)
-  if err != nil {
-    w.WriteHeader(http.StatusBadRequest)
-    io.WriteString(w, "Invalid Json: " + err.Error())
+  body, ok := readChangeBody(w, r)
+  if ! ok {
     return
   }
-  recipe.ID = id
 
-  db, tx, err := library.CreateTransaction()
+  db, tx, err := library.CreateWriteTransaction()
   if err != nil {
     log.Println(err)
     InternalError(w, r)
@@ -179,9 +392,64 @@ func UpdateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
   }
   defer db.Close()
 
+  oldRecipe, err := model.GetRecipeById(tx, id)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! oldRecipe.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  if preconditionFailed(w, r, versionTag(oldRecipe.Version)) {
+    tx.Rollback()
+    return
+  }
+
+  recipe := &model.Recipe{}
+  if ! applyChange(w, r, body, oldRecipe, recipe) {
+    tx.Rollback()
+    return
+  }
+
+  err = recipe.Validate()
+  if err != nil {
+    tx.Rollback()
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, err.Error())
+    return
+  }
+  recipe.ID = id
+  recipe.CreatedBy = oldRecipe.CreatedBy
+  recipe.CreatedAt = oldRecipe.CreatedAt
+  recipe.UpdatedBy = userId
+  recipe.Version = oldRecipe.Version
   err = recipe.Update(tx)
   if err != nil {
     tx.Rollback()
+    if versionConflict(w, err) {
+      return
+    }
+    if _, ok := err.(model.ValidationError); ok {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, err.Error())
+      return
+    }
     log.Println(err)
     InternalError(w, r)
     return
@@ -195,6 +463,7 @@ func UpdateRecipe(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  w.Header().Set("ETag", versionTag(recipe.Version))
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*recipe)
 }
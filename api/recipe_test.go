@@ -0,0 +1,99 @@
+package api
+
+import (
+  "database/sql"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
+)
+
+func createSoup(t *testing.T) {
+  t.Helper()
+  withTransaction(t, func(tx *sql.Tx) error {
+    recipe := &model.Recipe{Title: "Soup", Description: "Hot", CreatedBy: 1, UpdatedBy: 1}
+    return recipe.Create(tx)
+  })
+}
+
+func TestUpdateRecipePatch(t *testing.T) {
+  tempDatabase(t)
+  createSoup(t)
+
+  tests := []struct {
+    method string
+    contentType string
+    body string
+    code int
+    title string
+  }{
+    {"PATCH", library.MediaMergePatch, `{"title":"Stew"}`, http.StatusOK, "Stew"},
+    {"PATCH", library.MediaJsonPatch, `[{"op":"replace","path":"/title","value":"Broth"}]`, http.StatusOK, "Broth"},
+    {"PATCH", library.MediaJsonPatch, `[{"op":"test","path":"/title","value":"Soup"}]`, http.StatusConflict, "Broth"},
+    {"PATCH", "application/json", `{"title":"Stew"}`, http.StatusUnsupportedMediaType, "Broth"},
+    {"PUT", "application/json", `{"title":"Soup","description":"Cold"}`, http.StatusOK, "Soup"},
+    {"PUT", "application/json", `{"title":`, http.StatusBadRequest, "Soup"},
+  }
+
+  for _, test := range tests {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest(test.method, "/recipes/1", strings.NewReader(test.body))
+    r.Header.Set("Content-Type", test.contentType)
+    UpdateRecipe(1, w, mux.SetURLVars(r, map[string]string{"id": "1"}))
+    if w.Code != test.code {
+      t.Errorf("%s %s: %d, want %d", test.method, test.body, w.Code, test.code)
+    }
+    withTransaction(t, func(tx *sql.Tx) error {
+      recipe, err := model.GetRecipeById(tx, 1)
+      if err == nil && recipe.Title != test.title {
+        t.Errorf("%s %s: title %q, want %q", test.method, test.body, recipe.Title, test.title)
+      }
+      return err
+    })
+  }
+}
+
+// The body is read before the write lock is taken, a stalled client
+// doesn't block other writers
+func TestUpdateRecipeReadsBodyBeforeLocking(t *testing.T) {
+  tempDatabase(t)
+  createSoup(t)
+
+  body, client := io.Pipe()
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("PATCH", "/recipes/1", body)
+  r.Header.Set("Content-Type", library.MediaMergePatch)
+  done := make(chan bool)
+  go func() {
+    UpdateRecipe(1, w, mux.SetURLVars(r, map[string]string{"id": "1"}))
+    close(done)
+  }()
+  time.Sleep(50 * time.Millisecond)
+
+  db, tx, err := library.CreateWriteTransaction()
+  if err == nil {
+    _, err = tx.Exec("UPDATE `recipe` SET `description` = 'Warm' WHERE `id` = 1")
+    if err == nil {
+      err = tx.Commit()
+    } else {
+      tx.Rollback()
+    }
+    db.Close()
+  }
+  if err != nil {
+    t.Errorf("concurrent write while the body is pending: %v", err)
+  }
+
+  json.NewEncoder(client).Encode(map[string]string{"title": "Stew"})
+  client.Close()
+  <-done
+  if w.Code != http.StatusOK {
+    t.Errorf("patch: %d, want 200", w.Code)
+  }
+}
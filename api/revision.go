@@ -0,0 +1,314 @@
+package api
+
+import (
+  "database/sql"
+  "encoding/json"
+  "io"
+  "log"
+  "net/http"
+  "strconv"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+// The recipe as it is now, live or in the trash. Once it is deleted for
+// good it is the snapshot of its newest revision.
+func currentRecipe(tx *sql.Tx, id int64) (*model.Recipe, error) {
+  recipe, err := model.GetRecipeById(tx, id)
+  if err != nil && err.Error() == "sql: no rows in result set" {
+    recipe, err = model.GetTrashedRecipe(tx, id)
+  }
+  if err != nil && err.Error() == "sql: no rows in result set" {
+    var revision *model.Revision
+    revision, err = model.GetRevision(tx, id, 0)
+    if err == nil {
+      recipe = revision.Recipe
+    }
+  }
+  return recipe, err
+}
+
+// Revisions of a recipe in the trash are hidden like the recipe itself,
+// only its creator and admins see them. That stays so when the recipe is
+// deleted for good, then the newest revision tells the creator.
+func revisionsHidden(tx *sql.Tx, id, userId int64) (bool, error) {
+  _, err := model.GetRecipeById(tx, id)
+  if err == nil || err.Error() != "sql: no rows in result set" {
+    return false, err
+  }
+  recipe, err := model.GetTrashedRecipe(tx, id)
+  if err != nil && err.Error() == "sql: no rows in result set" {
+    var revision *model.Revision
+    revision, err = model.GetRevision(tx, id, 0)
+    if err != nil && err.Error() == "sql: no rows in result set" {
+      return false, nil
+    } else if err == nil && revision.Action != model.RevisionTrash && revision.Action != model.RevisionDelete {
+      return false, nil
+    }
+    if err == nil {
+      recipe = revision.Recipe
+    }
+  }
+  if err != nil {
+    return false, err
+  }
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    return false, err
+  }
+  return ! recipe.CanModify(user), nil
+}
+
+func ListRevisions(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  hidden, err := revisionsHidden(tx, id, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if hidden {
+    NotFound(w, r)
+    return
+  }
+
+  list, err := model.GetRevisions(tx, id)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  if len(list) == 0 {
+    // Recipes from before revisions existed have none yet
+    _, err = model.GetRecipeById(tx, id)
+    if err != nil {
+      if err.Error() != "sql: no rows in result set" {
+        log.Println(err)
+      }
+      NotFound(w, r)
+      return
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(list)
+}
+
+func GetRevision(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  number, err := strconv.Atoi(params["rev"])
+  if err != nil || number < 1 {
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  hidden, err := revisionsHidden(tx, id, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if hidden {
+    NotFound(w, r)
+    return
+  }
+
+  revision, err := model.GetRevision(tx, id, number)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*revision)
+}
+
+// Compares the revisions from and to, to defaults to the latest revision
+func DiffRevisions(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  from, err := strconv.Atoi(r.URL.Query().Get("from"))
+  if err != nil || from < 1 {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter from")
+    return
+  }
+  to := 0
+  if v := r.URL.Query().Get("to"); v != "" {
+    to, err = strconv.Atoi(v)
+    if err != nil || to < 1 {
+      w.WriteHeader(http.StatusBadRequest)
+      io.WriteString(w, "invalid parameter to")
+      return
+    }
+  }
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  hidden, err := revisionsHidden(tx, id, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if hidden {
+    NotFound(w, r)
+    return
+  }
+
+  fromRevision, err := model.GetRevision(tx, id, from)
+  var toRevision *model.Revision
+  if err == nil {
+    toRevision, err = model.GetRevision(tx, id, to)
+  }
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    return
+  }
+
+  diff := model.DiffRecipes(fromRevision.Recipe, toRevision.Recipe)
+  diff.From = fromRevision.Number
+  diff.To = toRevision.Number
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*diff)
+}
+
+// Stores the snapshot of a revision as new state of the recipe, this also
+// brings back deleted recipes
+func RestoreRevision(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+  number, err := strconv.Atoi(params["rev"])
+  if err != nil || number < 1 {
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateWriteTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  hidden, err := revisionsHidden(tx, id, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  } else if hidden {
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  revision, err := model.GetRevision(tx, id, number)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  current, err := currentRecipe(tx, id)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! current.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  recipe, err := revision.Restore(tx, userId)
+  if err != nil {
+    tx.Rollback()
+    if _, ok := err.(model.ValidationError); ok {
+      w.WriteHeader(http.StatusUnprocessableEntity)
+      io.WriteString(w, err.Error())
+      return
+    }
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*recipe)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+  "database/sql"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
+)
+
+// Creates an empty food.db in a temp dir and makes it the working dir
+// for the rest of the test
+func tempDatabase(t *testing.T) {
+  t.Helper()
+  cwd, err := os.Getwd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = os.Chdir(t.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    os.Chdir(cwd)
+  })
+
+  log.SetOutput(ioutil.Discard)
+  t.Cleanup(func() {
+    log.SetOutput(os.Stderr)
+  })
+  err = library.InitDb()
+  if err != nil && err != library.ErrNoFts5 {
+    t.Fatal(err)
+  }
+}
+
+func withTransaction(t *testing.T, fn func(tx *sql.Tx) error) {
+  t.Helper()
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  err = fn(tx)
+  if err != nil {
+    tx.Rollback()
+    t.Fatal(err)
+  }
+  err = tx.Commit()
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func createUser(t *testing.T, tx *sql.Tx, name, role string) *model.User {
+  t.Helper()
+  user := &model.User{Name: name, Enabled: true, Role: role}
+  user.SetPassword(name + "-secret")
+  err := user.Create(tx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return user
+}
+
+// Calls a handler of a logged in user with the route variables set
+func serve(handler func(userId int64, w http.ResponseWriter, r *http.Request), userId int64,
+  method, target string, vars map[string]string) int {
+  w := httptest.NewRecorder()
+  r := mux.SetURLVars(httptest.NewRequest(method, target, nil), vars)
+  handler(userId, w, r)
+  return w.Code
+}
+
+// A restore is authorized against the owner of the recipe as it is now,
+// not the creator in the restored snapshot
+func TestRestoreRevisionChecksCurrentOwner(t *testing.T) {
+  tempDatabase(t)
+  var before, after *model.User
+  var recipe *model.Recipe
+  withTransaction(t, func(tx *sql.Tx) error {
+    before = createUser(t, tx, "before", model.RoleEditor)
+    after = createUser(t, tx, "after", model.RoleEditor)
+    recipe = &model.Recipe{Title: "Soup", CreatedBy: before.ID, UpdatedBy: before.ID}
+    err := recipe.Create(tx)
+    if err != nil {
+      return err
+    }
+    _, err = tx.Exec("UPDATE `recipe` SET `created_by` = ? WHERE `id` = ?", after.ID, recipe.ID)
+    return err
+  })
+
+  vars := map[string]string{"id": "1", "rev": "1"}
+  if code := serve(RestoreRevision, before.ID, "POST", "/recipes/1/revisions/1/restore", vars); code != http.StatusForbidden {
+    t.Errorf("restore by the creator in the snapshot: %d, want 403", code)
+  }
+  if code := serve(RestoreRevision, after.ID, "POST", "/recipes/1/revisions/1/restore", vars); code != http.StatusOK {
+    t.Errorf("restore by the current owner: %d, want 200", code)
+  }
+}
+
+// Revisions of a purged recipe stay hidden like those of a trashed one
+func TestRevisionsOfPurgedRecipe(t *testing.T) {
+  tempDatabase(t)
+  var creator, viewer *model.User
+  withTransaction(t, func(tx *sql.Tx) error {
+    creator = createUser(t, tx, "creator", model.RoleEditor)
+    viewer = createUser(t, tx, "viewer", model.RoleViewer)
+    recipe := &model.Recipe{Title: "Soup", CreatedBy: creator.ID, UpdatedBy: creator.ID}
+    err := recipe.Create(tx)
+    if err != nil {
+      return err
+    }
+    return recipe.Trash(tx)
+  })
+  err := purgeTrash(0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  withTransaction(t, func(tx *sql.Tx) error {
+    if _, err := model.GetTrashedRecipe(tx, 1); err != sql.ErrNoRows {
+      t.Fatalf("recipe not purged: %v", err)
+    }
+    return nil
+  })
+
+  requests := []struct {
+    handler func(userId int64, w http.ResponseWriter, r *http.Request)
+    target string
+    vars map[string]string
+  }{
+    {ListRevisions, "/recipes/1/revisions", map[string]string{"id": "1"}},
+    {GetRevision, "/recipes/1/revisions/1", map[string]string{"id": "1", "rev": "1"}},
+    {DiffRevisions, "/recipes/1/revisions/diff?from=1", map[string]string{"id": "1"}},
+  }
+  for _, request := range requests {
+    if code := serve(request.handler, viewer.ID, "GET", request.target, request.vars); code != http.StatusNotFound {
+      t.Errorf("%s as viewer: %d, want 404", request.target, code)
+    }
+    // The first user created by InitDb is an admin
+    for _, userId := range []int64{creator.ID, 1} {
+      if code := serve(request.handler, userId, "GET", request.target, request.vars); code != http.StatusOK {
+        t.Errorf("%s as user %d: %d, want 200", request.target, userId, code)
+      }
+    }
+  }
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+  "encoding/json"
+  "log"
+  "net/http"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+func ListTags(w http.ResponseWriter, r *http.Request) {
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  tags, err := model.GetTags(tx)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(tags)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+  "encoding/json"
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+  "github.com/gorilla/mux"
+  "github.com/hc42/food-api/model"
+  "github.com/hc42/food-api/library"
+)
+
+// Admins see the whole trash, other users the recipes they created
+func ListTrash(userId int64, w http.ResponseWriter, r *http.Request) {
+  page, limit := pageParams(r)
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  createdBy := user.ID
+  if user.IsAdmin() {
+    createdBy = 0
+  }
+
+  result, err := model.GetTrashPage(tx, page, limit, createdBy)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  setPageLinks(w, r, result.Page, result.Pages)
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*result)
+}
+
+func RestoreTrash(userId int64, w http.ResponseWriter, r *http.Request) {
+  params := mux.Vars(r)
+  id, err := strconv.ParseInt(params["id"], 10, 64)
+  if err != nil {
+    log.Println(err)
+    NotFound(w, r)
+    return
+  }
+
+  db, tx, err := library.CreateWriteTransaction()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  defer db.Close()
+
+  recipe, err := model.GetTrashedRecipe(tx, id)
+  if err != nil {
+    if err.Error() != "sql: no rows in result set" {
+      log.Println(err)
+    }
+    NotFound(w, r)
+    tx.Rollback()
+    return
+  }
+
+  user, err := model.GetUser(tx, userId)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    tx.Rollback()
+    return
+  }
+
+  if ! recipe.CanModify(user) {
+    forbidden(w)
+    tx.Rollback()
+    return
+  }
+
+  recipe.UpdatedBy = userId
+  err = recipe.Untrash(tx)
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(*recipe)
+}
+
+// Deletes recipes that are in the trash longer than retention every
+// interval, runs until the process ends
+func StartTrashPurge(retention, interval time.Duration) {
+  go func() {
+    for {
+      err := purgeTrash(retention)
+      if err != nil {
+        log.Println(err)
+      }
+      time.Sleep(interval)
+    }
+  }()
+}
+
+func purgeTrash(retention time.Duration) error {
+  for {
+    db, tx, err := library.CreateTransaction()
+    if err != nil {
+      return err
+    }
+
+    expired, err := model.GetExpiredTrash(tx, time.Now().UTC().Add(-retention))
+    for idx := range expired {
+      if err != nil {
+        break
+      }
+      // The revision of a purge has no user
+      expired[idx].UpdatedBy = 0
+      err = expired[idx].Delete(tx)
+    }
+    if err == nil {
+      err = tx.Commit()
+    }
+    if err != nil {
+      tx.Rollback()
+      db.Close()
+      return err
+    }
+    db.Close()
+
+    for _, recipe := range expired {
+      for idx := range recipe.Images {
+        deleteImageFiles(&(recipe.Images[idx]))
+      }
+    }
+    if len(expired) == 0 {
+      return nil
+    }
+    log.Printf("Purged %d recipes from the trash\n", len(expired))
+  }
+}
@@ -6,12 +6,18 @@ import (
   "log"
   "net/http"
   "strconv"
+  "time"
   "github.com/gorilla/mux"
   "github.com/hc42/food-api/model"
   "github.com/hc42/food-api/library"
 )
 
+// Deprecated login with the credentials in the query string, use Login.
+// The token is returned in the Authorization header.
 func UserLogin(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Deprecation", "true")
+  w.Header().Set("Link", "</auth/login>; rel=\"successor-version\"")
+
   params := r.URL.Query()
   name, ok := params["name"]
   if ! ok || len(name) == 0 {
@@ -26,6 +32,53 @@ func UserLogin(w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  user, wait, err := authenticate(r, name[0], password[0])
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if wait > 0 {
+    tooManyRequests(w, wait)
+    return
+  } else if user != nil {
+    SetToken(user, w)
+    return
+  }
+  NotFound(w, r)
+}
+
+func Login(w http.ResponseWriter, r *http.Request) {
+  var credentials struct {
+    Name string `json:"name"`
+    Password string `json:"password"`
+  }
+
+  err := json.NewDecoder(r.Body).Decode(&credentials)
+  if err != nil {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Invalid Json: " + err.Error())
+    return
+  }
+  if credentials.Name == "" || credentials.Password == "" {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "name and password are required")
+    return
+  }
+
+  user, wait, err := authenticate(r, credentials.Name, credentials.Password)
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  } else if wait > 0 {
+    tooManyRequests(w, wait)
+    return
+  } else if user == nil {
+    notLoggedIn(w)
+    io.WriteString(w, "invalid name or password")
+    return
+  }
+
   db, tx, err := library.CreateTransaction()
   if err != nil {
     log.Println(err)
@@ -33,16 +86,123 @@ func UserLogin(w http.ResponseWriter, r *http.Request) {
     return
   }
   defer db.Close()
-  defer tx.Commit()
 
-  user, err := model.GetUserByName(tx, name[0])
-  if err != nil && err.Error() != "sql: no rows in result set" {
+  err = model.DeleteExpiredRefreshTokens(tx)
+  if err == nil {
+    err = library.DeleteExpiredRevocations(tx)
+  }
+  if err == nil {
+    err = loginPolicy.DeleteStaleLockouts(tx)
+  }
+  if err != nil {
+    tx.Rollback()
     log.Println(err)
-  } else if user.CheckPassword(password[0]) && user.Enabled {
-    SetToken(user, w)
+    InternalError(w, r)
     return
   }
-  NotFound(w, r)
+  stored, refreshToken, err := model.NewRefreshToken(tx, user.ID)
+  if err != nil {
+    tx.Rollback()
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  writeTokens(w, r, user, stored, refreshToken)
+}
+
+// Returns the enabled user with the given credentials, nil if there is
+// none. Failures are counted per account name and client address, a wait
+// above zero means the login is throttled and the password wasn't checked.
+func authenticate(r *http.Request, name, password string) (*model.User, time.Duration, error) {
+  address := clientAddress(r)
+  user, previous, wait, err := reserveLogin(name, address)
+  if err != nil || wait > 0 || user == nil {
+    return nil, wait, err
+  }
+  if ! user.CheckPassword(password) || ! user.Enabled {
+    return nil, 0, nil
+  }
+
+  db, tx, err := library.CreateWriteTransaction()
+  if err != nil {
+    return nil, 0, err
+  }
+  defer db.Close()
+
+  // The address keeps its earlier failures, one valid account must not
+  // hide guesses at others
+  err = model.ClearLoginFailures(tx, model.LockoutAccount, name)
+  if err == nil {
+    err = loginPolicy.ReleaseFailure(tx, model.LockoutAddress, address, previous)
+  }
+  if err != nil {
+    tx.Rollback()
+    return nil, 0, err
+  }
+  err = tx.Commit()
+  if err != nil {
+    return nil, 0, err
+  }
+  return user, 0, nil
+}
+
+// Counts the attempt as failed before the slow password check, so parallel
+// guesses can't all pass the wait. Returns the user if the name exists and
+// the failures of the address before this attempt to take it back later.
+func reserveLogin(name, address string) (*model.User, *model.Lockout, time.Duration, error) {
+  db, tx, err := library.CreateWriteTransaction()
+  if err != nil {
+    return nil, nil, 0, err
+  }
+  defer db.Close()
+
+  wait, err := model.LoginWait(tx, model.LockoutAccount, name)
+  if err != nil {
+    tx.Rollback()
+    return nil, nil, 0, err
+  }
+  addressWait, err := model.LoginWait(tx, model.LockoutAddress, address)
+  if err != nil {
+    tx.Rollback()
+    return nil, nil, 0, err
+  }
+  if addressWait > wait {
+    wait = addressWait
+  }
+  if wait > 0 {
+    tx.Rollback()
+    return nil, nil, wait, nil
+  }
+
+  user, err := model.GetUserByName(tx, name)
+  if err != nil && err.Error() != "sql: no rows in result set" {
+    tx.Rollback()
+    return nil, nil, 0, err
+  } else if err != nil {
+    user = nil
+  }
+  previous, err := model.GetLockout(tx, model.LockoutAddress, address)
+  if err == nil {
+    err = loginPolicy.RecordFailure(tx, model.LockoutAccount, name)
+  }
+  if err == nil {
+    err = loginPolicy.RecordFailure(tx, model.LockoutAddress, address)
+  }
+  if err != nil {
+    tx.Rollback()
+    return nil, nil, 0, err
+  }
+  err = tx.Commit()
+  if err != nil {
+    return nil, nil, 0, err
+  }
+  return user, previous, 0, nil
 }
 
 func GetSelf(userId int64, w http.ResponseWriter, r *http.Request) {
@@ -73,27 +233,12 @@ func GetSelf(userId int64, w http.ResponseWriter, r *http.Request) {
 
 func UpdateSelf(userId int64, w http.ResponseWriter, r *http.Request) {
 
-  user := &model.User{}
-  err := json.NewDecoder(r.Body).Decode(user)
-  if err != nil {
-    w.WriteHeader(http.StatusBadRequest)
-    io.WriteString(w, "Invalid Json: " + err.Error())
-    return
-  }
-
-  if userId != user.ID {
-    w.WriteHeader(http.StatusBadRequest)
-    io.WriteString(w, "Selected user must be self")
-    return
-  }
-
-  if ! user.Enabled {
-    w.WriteHeader(http.StatusBadRequest)
-    io.WriteString(w, "Can't disable own account")
+  body, ok := readChangeBody(w, r)
+  if ! ok {
     return
   }
 
-  db, tx, err := library.CreateTransaction()
+  db, tx, err := library.CreateWriteTransaction()
   defer db.Close()
 
   oldUser, err := model.GetUser(tx, userId)
@@ -107,6 +252,26 @@ func UpdateSelf(userId int64, w http.ResponseWriter, r *http.Request) {
     }
   }
 
+  user := &model.User{}
+  if ! applyChange(w, r, body, oldUser, user) {
+    tx.Rollback()
+    return
+  }
+
+  if userId != user.ID {
+    tx.Rollback()
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Selected user must be self")
+    return
+  }
+
+  if ! user.Enabled {
+    tx.Rollback()
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Can't disable own account")
+    return
+  }
+
   oldUser.Name = user.Name
 
   err = oldUser.Update(tx)
@@ -114,7 +279,7 @@ func UpdateSelf(userId int64, w http.ResponseWriter, r *http.Request) {
     if err.Error() == "UNIQUE constraint failed: user.name" {
       w.WriteHeader(http.StatusBadRequest)
       io.WriteString(w, "name already in use")
-    } else {
+    } else if ! versionConflict(w, err) {
       log.Println(err)
       InternalError(w, r)
     }
@@ -130,6 +295,7 @@ func UpdateSelf(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  w.Header().Set("ETag", versionTag(oldUser.Version))
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*oldUser)
 }
@@ -149,7 +315,7 @@ func SetPassword(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  db, tx, err := library.CreateTransaction()
+  db, tx, err := library.CreateWriteTransaction()
   defer db.Close()
 
   user, err := model.GetUser(tx, userId)
@@ -178,6 +344,25 @@ func SetPassword(userId int64, w http.ResponseWriter, r *http.Request) {
   }
 
   err = user.Update(tx)
+  if err != nil {
+    tx.Rollback();
+    if versionConflict(w, err) {
+      return
+    }
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+
+  // Sessions that knew the old password end, the caller gets a new one
+  err = user.RevokeTokens(tx)
+  if err != nil {
+    tx.Rollback();
+    log.Println(err)
+    InternalError(w, r)
+    return
+  }
+  stored, refreshToken, err := model.NewRefreshToken(tx, user.ID)
   if err != nil {
     tx.Rollback();
     log.Println(err)
@@ -192,6 +377,7 @@ func SetPassword(userId int64, w http.ResponseWriter, r *http.Request) {
     InternalError(w, r)
     return
   }
+  writeTokens(w, r, user, stored, refreshToken)
 }
 
 func CreateUser(userId int64, w http.ResponseWriter, r *http.Request) {
@@ -207,6 +393,14 @@ func CreateUser(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  if newUser.User.Role == "" {
+    newUser.User.Role = model.RoleViewer
+  } else if ! model.ValidRole(newUser.User.Role) {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Invalid role")
+    return
+  }
+
   db, tx, err := library.CreateTransaction()
   defer db.Close()
 
@@ -240,21 +434,7 @@ func CreateUser(userId int64, w http.ResponseWriter, r *http.Request) {
 }
 
 func ListUsers(userId int64, w http.ResponseWriter, r *http.Request) {
-  var limit int = 25
-  var page int = 1
-  params := r.URL.Query()
-
-  if v, ok := params["limit"]; ok && len(v) > 0 {
-    if overwriteLimit, err := strconv.Atoi(v[0]); err == nil && overwriteLimit > 0 && overwriteLimit < 1000 {
-      limit = overwriteLimit
-    }
-  }
-
-  if v, ok := params["page"]; ok && len(v) > 0 {
-    if overwritePage, err := strconv.Atoi(v[0]); err == nil && overwritePage > 0 {
-      page = overwritePage
-    }
-  }
+  page, limit := pageParams(r)
 
   db, tx, err := library.CreateTransaction()
   if err != nil {
@@ -265,13 +445,28 @@ func ListUsers(userId int64, w http.ResponseWriter, r *http.Request) {
   defer db.Close()
   defer tx.Commit()
 
-  result, err := model.GetUserPage(tx, page, limit)
-  if err != nil {
+  var result *model.UserListPage
+  cursor, useCursor := cursorParam(r)
+  if useCursor {
+    result, err = model.GetUserCursor(tx, cursor, limit)
+  } else {
+    result, err = model.GetUserPage(tx, page, limit)
+  }
+  if err == model.ErrInvalidCursor {
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "invalid parameter cursor")
+    return
+  } else if err != nil {
     log.Println(err)
     InternalError(w, r)
     return
   }
 
+  if useCursor {
+    setCursorLinks(w, r, result.NextCursor)
+  } else {
+    setPageLinks(w, r, result.Page, result.Pages)
+  }
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*result)
 }
@@ -305,6 +500,11 @@ func GetUser(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  tag := versionTag(user.Version)
+  if notModified(w, r, tag) {
+    return
+  }
+  w.Header().Set("ETag", tag)
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*user)
 }
@@ -377,15 +577,12 @@ func UpdateUser(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  user := &model.User{}
-  err = json.NewDecoder(r.Body).Decode(user)
-  if err != nil {
-    w.WriteHeader(http.StatusBadRequest)
-    io.WriteString(w, "Invalid Json: " + err.Error())
+  body, ok := readChangeBody(w, r)
+  if ! ok {
     return
   }
 
-  db, tx, err := library.CreateTransaction()
+  db, tx, err := library.CreateWriteTransaction()
   defer db.Close()
 
   oldUser, err := model.GetUser(tx, id)
@@ -399,15 +596,40 @@ func UpdateUser(userId int64, w http.ResponseWriter, r *http.Request) {
     }
   }
 
+  if preconditionFailed(w, r, versionTag(oldUser.Version)) {
+    tx.Rollback()
+    return
+  }
+
+  user := &model.User{}
+  if ! applyChange(w, r, body, oldUser, user) {
+    tx.Rollback()
+    return
+  }
+
+  if user.Role != "" && ! model.ValidRole(user.Role) {
+    tx.Rollback()
+    w.WriteHeader(http.StatusBadRequest)
+    io.WriteString(w, "Invalid role")
+    return
+  }
+
+  disabled := oldUser.Enabled && ! user.Enabled
   oldUser.Name = user.Name
   oldUser.Enabled = user.Enabled
+  if user.Role != "" {
+    oldUser.Role = user.Role
+  }
 
   err = oldUser.Update(tx)
+  if err == nil && disabled {
+    err = oldUser.RevokeTokens(tx)
+  }
   if err != nil {
     if err.Error() == "UNIQUE constraint failed: user.name" {
       w.WriteHeader(http.StatusBadRequest)
       io.WriteString(w, "name already in use")
-    } else {
+    } else if ! versionConflict(w, err) {
       log.Println(err)
       InternalError(w, r)
     }
@@ -423,6 +645,7 @@ func UpdateUser(userId int64, w http.ResponseWriter, r *http.Request) {
     return
   }
 
+  w.Header().Set("ETag", versionTag(oldUser.Version))
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(*oldUser)
 }
@@ -2,9 +2,11 @@ package library
 
 import (
   "database/sql"
+  "errors"
   "fmt"
   "log"
   "math/rand"
+  "strings"
   "time"
   _ "github.com/mattn/go-sqlite3"
   "github.com/hc42/food-api/model"
@@ -21,8 +23,33 @@ func InitDb() error {
   if err != nil {
     return err
   }
+  hasAmounts, err := hasColumn(db, "ingredient", "amount")
+  if err != nil {
+    return err
+  }
+  err = migrateSchema(db)
+  if err != nil {
+    return err
+  }
+  err = migrateRecipeIds(db)
+  if err != nil {
+    return err
+  }
+  if ! hasAmounts {
+    err = parseIngredientQuantities(db)
+    if err != nil {
+      return err
+    }
+  }
   err = createFirstUser(db)
-  return err
+  if err != nil {
+    return err
+  }
+  err = assignRecipeOwners(db)
+  if err != nil {
+    return err
+  }
+  return createSearchIndex(db)
 }
 
 func createFirstUser(db *sql.DB) error {
@@ -37,7 +64,7 @@ func createFirstUser(db *sql.DB) error {
   }
   rand.Seed(time.Now().UTC().UnixNano())
   newPassword := fmt.Sprintf("admin%d", rand.Intn(1000000))
-  newUser := model.User{Name:"admin", Enabled:true}
+  newUser := model.User{Name:"admin", Enabled:true, Role:model.RoleAdmin}
   newUser.SetPassword(newPassword)
   tx, err := db.Begin()
   if err != nil {
@@ -63,7 +90,18 @@ func ConnectDb() (*sql.DB, error) {
 }
 
 func CreateTransaction() (*sql.DB, *sql.Tx, error) {
-  db, err := sql.Open("sqlite3", "food.db")
+  return openTransaction("food.db")
+}
+
+// For changes that check a version they read first. The write lock is
+// taken at the start, so concurrent writers wait for each other and see
+// the committed version instead of failing with a busy database.
+func CreateWriteTransaction() (*sql.DB, *sql.Tx, error) {
+  return openTransaction("food.db?_txlock=immediate&_busy_timeout=5000")
+}
+
+func openTransaction(dataSource string) (*sql.DB, *sql.Tx, error) {
+  db, err := sql.Open("sqlite3", dataSource)
   if err != nil {
     return nil, nil, err
   }
@@ -83,20 +121,105 @@ func createSchema(db *sql.DB) error {
     "`id` INTEGER NOT NULL PRIMARY KEY," +
     "`name` VARCHAR(255) NOT NULL UNIQUE," +
     "`enabled` BOOL NOT NULL," +
-    "`password` VARCHAR(255) NULL)")
+    "`role` VARCHAR(32) NOT NULL DEFAULT 'editor'," +
+    "`password` VARCHAR(255) NULL," +
+    "`version` INTEGER NOT NULL DEFAULT 1," +
+    "`tokens_revoked_at` DATETIME NULL)")
 
-  tables = append(tables, "CREATE TABLE IF NOT EXISTS `recipe` (" +
-    "`id` INTEGER NOT NULL PRIMARY KEY," +
-    "`title` VARCHAR(255) NOT NULL," +
-    "`description` TEXT NOT NULL)")
+  tables = append(tables, recipeTable("recipe"))
 
   tables = append(tables, "CREATE TABLE IF NOT EXISTS `ingredient` (" +
     "`id` INTEGER NOT NULL PRIMARY KEY," +
     "`name` VARCHAR(255) NOT NULL," +
     "`quantity` VARCHAR(255) NULL," +
+    "`amount` REAL NULL," +
+    "`unit` VARCHAR(32) NOT NULL DEFAULT ''," +
+    "`note` VARCHAR(255) NOT NULL DEFAULT ''," +
     "`recipe` INTEGER NOT NULL," +
     "FOREIGN KEY(recipe) REFERENCES reipce(id))")
 
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `step` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`text` TEXT NOT NULL," +
+    "`duration` INTEGER NULL," +
+    "`position` INTEGER NOT NULL," +
+    "`recipe` INTEGER NOT NULL," +
+    "FOREIGN KEY(recipe) REFERENCES recipe(id))")
+
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `step_ingredient` (" +
+    "`step` INTEGER NOT NULL," +
+    "`ingredient` INTEGER NOT NULL," +
+    "PRIMARY KEY(step, ingredient)," +
+    "FOREIGN KEY(step) REFERENCES step(id)," +
+    "FOREIGN KEY(ingredient) REFERENCES ingredient(id))")
+
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `tag` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`name` VARCHAR(64) NOT NULL UNIQUE)")
+
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `recipe_tag` (" +
+    "`recipe` INTEGER NOT NULL," +
+    "`tag` INTEGER NOT NULL," +
+    "PRIMARY KEY(recipe, tag)," +
+    "FOREIGN KEY(recipe) REFERENCES recipe(id)," +
+    "FOREIGN KEY(tag) REFERENCES tag(id))")
+
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `image` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`recipe` INTEGER NOT NULL," +
+    "`content_type` VARCHAR(64) NOT NULL," +
+    "`width` INTEGER NOT NULL," +
+    "`height` INTEGER NOT NULL," +
+    "`created_by` INTEGER NOT NULL," +
+    "`created_at` DATETIME NOT NULL," +
+    "FOREIGN KEY(recipe) REFERENCES recipe(id))")
+
+  // Access tokens revoked by a logout, kept until they expire anyway
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `revoked_token` (" +
+    "`jti` VARCHAR(64) NOT NULL PRIMARY KEY," +
+    "`expires_at` DATETIME NOT NULL)")
+
+  // Only a hash of the token is stored. All tokens issued from one login
+  // share a family, replaying a used token revokes the family.
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `refresh_token` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`hash` VARCHAR(64) NOT NULL UNIQUE," +
+    "`family` VARCHAR(64) NOT NULL," +
+    "`user` INTEGER NOT NULL," +
+    "`created_at` DATETIME NOT NULL," +
+    "`expires_at` DATETIME NOT NULL," +
+    "`used_at` DATETIME NULL," +
+    "`revoked_at` DATETIME NULL," +
+    "FOREIGN KEY(user) REFERENCES user(id))")
+
+  // Failed logins per account name or client address, the name doesn't
+  // have to exist
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `login_failure` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`kind` VARCHAR(16) NOT NULL," +
+    "`key` VARCHAR(255) NOT NULL," +
+    "`failures` INTEGER NOT NULL," +
+    "`last_failure` DATETIME NOT NULL," +
+    "`locked_until` DATETIME NOT NULL," +
+    "UNIQUE(`kind`, `key`))")
+
+  // No foreign key, revisions outlive deleted recipes
+  tables = append(tables, "CREATE TABLE IF NOT EXISTS `revision` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY," +
+    "`recipe` INTEGER NOT NULL," +
+    "`number` INTEGER NOT NULL," +
+    "`action` VARCHAR(16) NOT NULL," +
+    "`snapshot` TEXT NOT NULL," +
+    "`created_by` INTEGER NOT NULL," +
+    "`created_at` DATETIME NOT NULL," +
+    "UNIQUE(`recipe`, `number`))")
+
+  // Relations are loaded for batches of recipes with WHERE recipe IN (...)
+  tables = append(tables, "CREATE INDEX IF NOT EXISTS `ingredient_recipe` ON `ingredient` (`recipe`)")
+  tables = append(tables, "CREATE INDEX IF NOT EXISTS `step_recipe` ON `step` (`recipe`)")
+  tables = append(tables, "CREATE INDEX IF NOT EXISTS `image_recipe` ON `image` (`recipe`)")
+  tables = append(tables, "CREATE INDEX IF NOT EXISTS `revision_recipe` ON `revision` (`recipe`)")
+
   for _, table := range tables {
     _, err := db.Exec(table)
     if err != nil {
@@ -105,3 +228,269 @@ func createSchema(db *sql.DB) error {
   }
   return nil
 }
+
+// Ids of deleted recipes are never handed out again, their revisions are
+// kept and would belong to the new recipe
+func recipeTable(name string) string {
+  return "CREATE TABLE IF NOT EXISTS `" + name + "` (" +
+    "`id` INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT," +
+    "`title` VARCHAR(255) NOT NULL," +
+    "`description` TEXT NOT NULL," +
+    "`servings` INTEGER NOT NULL DEFAULT 0," +
+    "`prep_time` INTEGER NULL," +
+    "`cook_time` INTEGER NULL," +
+    "`total_time` INTEGER NULL," +
+    "`created_by` INTEGER NOT NULL DEFAULT 0," +
+    "`updated_by` INTEGER NOT NULL DEFAULT 0," +
+    "`created_at` DATETIME NULL," +
+    "`updated_at` DATETIME NULL," +
+    "`deleted_at` DATETIME NULL," +
+    "`deleted_by` INTEGER NULL," +
+    "`version` INTEGER NOT NULL DEFAULT 1)"
+}
+
+type column struct {
+  table string
+  name string
+  definition string
+}
+
+// Columns added after the first release, CREATE TABLE IF NOT EXISTS won't
+// add them to an existing food.db
+var addedColumns = []column{
+  {"user", "role", "VARCHAR(32) NOT NULL DEFAULT 'editor'"},
+  {"recipe", "created_by", "INTEGER NOT NULL DEFAULT 0"},
+  {"recipe", "updated_by", "INTEGER NOT NULL DEFAULT 0"},
+  {"recipe", "created_at", "DATETIME NULL"},
+  {"recipe", "updated_at", "DATETIME NULL"},
+  {"recipe", "servings", "INTEGER NOT NULL DEFAULT 0"},
+  {"recipe", "prep_time", "INTEGER NULL"},
+  {"recipe", "cook_time", "INTEGER NULL"},
+  {"recipe", "total_time", "INTEGER NULL"},
+  {"recipe", "deleted_at", "DATETIME NULL"},
+  {"recipe", "deleted_by", "INTEGER NULL"},
+  {"recipe", "version", "INTEGER NOT NULL DEFAULT 1"},
+  {"user", "version", "INTEGER NOT NULL DEFAULT 1"},
+  {"user", "tokens_revoked_at", "DATETIME NULL"},
+  {"ingredient", "amount", "REAL NULL"},
+  {"ingredient", "unit", "VARCHAR(32) NOT NULL DEFAULT ''"},
+  {"ingredient", "note", "VARCHAR(255) NOT NULL DEFAULT ''"},
+}
+
+func hasColumn(db *sql.DB, table, name string) (bool, error) {
+  rows, err := db.Query("PRAGMA table_info(`" + table + "`)")
+  if err != nil {
+    return false, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var cid, notNull, pk int
+    var columnName, columnType string
+    var defaultValue sql.NullString
+    err = rows.Scan(&cid, &columnName, &columnType, &notNull, &defaultValue, &pk)
+    if err != nil {
+      return false, err
+    }
+    if columnName == name {
+      return true, nil
+    }
+  }
+  return false, rows.Err()
+}
+
+func migrateSchema(db *sql.DB) error {
+  for _, c := range addedColumns {
+    found, err := hasColumn(db, c.table, c.name)
+    if err != nil {
+      return err
+    }
+    if found {
+      continue
+    }
+    log.Printf("Add column %s.%s\n", c.table, c.name)
+    _, err = db.Exec("ALTER TABLE `" + c.table + "` ADD COLUMN `" + c.name + "` " + c.definition)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Recipe tables from before AUTOINCREMENT handed the id of the newest
+// recipe out again after it was deleted, the new recipe got its revisions.
+// The table is rebuilt and ids continue after every id with revisions.
+func migrateRecipeIds(db *sql.DB) error {
+  var schema string
+  err := db.QueryRow("SELECT `sql` FROM `sqlite_master` WHERE `type` = 'table' AND `name` = 'recipe'").Scan(&schema)
+  if err != nil || strings.Contains(schema, "AUTOINCREMENT") {
+    return err
+  }
+  log.Println("Rebuild recipe table with AUTOINCREMENT ids")
+
+  columns := "`id`, `title`, `description`, `servings`, `prep_time`, `cook_time`, `total_time`, " +
+    "`created_by`, `updated_by`, `created_at`, `updated_at`, `deleted_at`, `deleted_by`, `version`"
+  statements := []string{
+    recipeTable("recipe_rebuild"),
+    "INSERT INTO `recipe_rebuild` (" + columns + ") SELECT " + columns + " FROM `recipe`",
+    "DROP TABLE `recipe`",
+    "ALTER TABLE `recipe_rebuild` RENAME TO `recipe`",
+    "DELETE FROM `sqlite_sequence` WHERE `name` IN ('recipe', 'recipe_rebuild')",
+    "INSERT INTO `sqlite_sequence` (`name`, `seq`) SELECT 'recipe', " +
+      "MAX(COALESCE((SELECT MAX(`id`) FROM `recipe`), 0), COALESCE((SELECT MAX(`recipe`) FROM `revision`), 0))",
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  for _, statement := range statements {
+    _, err = tx.Exec(statement)
+    if err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// Databases created before roles and recipe ownership have no admin and no
+// recipe authors, hand everything to the first user created by createFirstUser.
+// Recipes without timestamps count as created now.
+func assignRecipeOwners(db *sql.DB) error {
+  _, err := db.Exec(
+    "UPDATE `user` SET `role` = ? WHERE `id` = (SELECT MIN(`id`) FROM `user`) " +
+    "AND NOT EXISTS (SELECT 1 FROM `user` WHERE `role` = ?)", model.RoleAdmin, model.RoleAdmin)
+  if err != nil {
+    return err
+  }
+  result, err := db.Exec(
+    "UPDATE `recipe` SET `created_by` = (SELECT MIN(`id`) FROM `user` WHERE `role` = ?) " +
+    "WHERE `created_by` = 0", model.RoleAdmin)
+  if err != nil {
+    return err
+  }
+  if count, err := result.RowsAffected(); err == nil && count > 0 {
+    log.Printf("%d recipes without author assigned to first admin\n", count)
+  }
+  _, err = db.Exec("UPDATE `recipe` SET `updated_by` = `created_by` WHERE `updated_by` = 0")
+  if err != nil {
+    return err
+  }
+  _, err = db.Exec("UPDATE `recipe` SET `created_at` = CURRENT_TIMESTAMP WHERE `created_at` IS NULL")
+  if err != nil {
+    return err
+  }
+  _, err = db.Exec("UPDATE `recipe` SET `updated_at` = `created_at` WHERE `updated_at` IS NULL")
+  return err
+}
+
+// Returned by InitDb when SQLite was built without FTS5, everything else
+// is set up and the server can run with search disabled
+var ErrNoFts5 = errors.New("SQLite without FTS5, build with go build -tags sqlite_fts5 or set SEARCH=off")
+
+// The full text index needs SQLite with FTS5 (go build -tags sqlite_fts5)
+func createSearchIndex(db *sql.DB) error {
+  _, err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS `recipe_search` USING fts5(" +
+    "`title`, `description`, `ingredients`, tokenize = 'unicode61 remove_diacritics 2')")
+  if err != nil {
+    if strings.HasPrefix(err.Error(), "no such module: fts5") {
+      return ErrNoFts5
+    }
+    return err
+  }
+  model.SearchEnabled = true
+
+  // Recipes changed by a server running without search are missing or
+  // outdated in the index
+  var stale int
+  err = db.QueryRow("SELECT " +
+    "(SELECT COUNT(*) FROM `recipe` LEFT JOIN `recipe_search` ON `recipe_search`.`rowid` = `recipe`.`id` " +
+    "WHERE `recipe`.`deleted_at` IS NULL AND (`recipe_search`.`rowid` IS NULL " +
+    "OR `recipe_search`.`title` != `recipe`.`title` OR `recipe_search`.`description` != `recipe`.`description` " +
+    "OR `recipe_search`.`ingredients` != " + model.SearchIngredients + ")) + " +
+    "(SELECT COUNT(*) FROM `recipe_search` WHERE `rowid` NOT IN " +
+    "(SELECT `id` FROM `recipe` WHERE `deleted_at` IS NULL))").Scan(&stale)
+  if err != nil || stale == 0 {
+    return err
+  }
+
+  log.Printf("%d recipes outdated in search index, rebuild it\n", stale)
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec("DELETE FROM `recipe_search`")
+  if err == nil {
+    _, err = tx.Exec(
+      "INSERT INTO `recipe_search` (`rowid`, `title`, `description`, `ingredients`) " +
+      "SELECT `id`, `title`, `description`, " + model.SearchIngredients + " FROM `recipe` " +
+      "WHERE `recipe`.`deleted_at` IS NULL")
+  }
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+  }
+  return err
+}
+
+// Fills amount, unit and note of ingredients stored before quantities were
+// structured, texts the parser doesn't understand stay as they are
+func parseIngredientQuantities(db *sql.DB) error {
+  log.Println("Parse ingredient quantities")
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  err = parseIngredientQuantitiesTx(tx)
+  if err == nil {
+    err = tx.Commit()
+  }
+  if err != nil {
+    tx.Rollback()
+  }
+  return err
+}
+
+func parseIngredientQuantitiesTx(tx *sql.Tx) error {
+  type parsed struct {
+    id int64
+    quantity model.Quantity
+  }
+  var updates []parsed
+  var failed int
+
+  rows, err := tx.Query("SELECT `id`, `quantity` FROM `ingredient` WHERE `quantity` IS NOT NULL AND `quantity` != ''")
+  if err != nil {
+    return err
+  }
+  for rows.Next() {
+    var id int64
+    var text string
+    err = rows.Scan(&id, &text)
+    if err != nil {
+      rows.Close()
+      return err
+    }
+    if quantity, ok := model.ParseQuantity(text); ok {
+      updates = append(updates, parsed{id, quantity})
+    } else {
+      failed++
+    }
+  }
+  err = rows.Err()
+  rows.Close()
+  if err != nil {
+    return err
+  }
+
+  for _, update := range updates {
+    _, err = tx.Exec("UPDATE `ingredient` SET `amount` = ?, `unit` = ?, `note` = ? WHERE `id` = ?",
+      update.quantity.Amount, update.quantity.Unit, update.quantity.Note, update.id)
+    if err != nil {
+      return err
+    }
+  }
+  log.Printf("%d ingredient quantities parsed, %d kept as text\n", len(updates), failed)
+  return nil
+}
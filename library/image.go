@@ -0,0 +1,132 @@
+package library
+
+import (
+  "bytes"
+  "errors"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/jpeg"
+  "net/http"
+  _ "image/gif"
+  _ "image/png"
+  "github.com/hc42/food-api/model"
+)
+
+// Larger images are refused before decoding them
+const maxImagePixels = 40000000
+
+var imageTypes = map[string]bool{
+  "image/jpeg": true,
+  "image/png": true,
+  "image/gif": true,
+}
+
+var ErrImageType = errors.New("unsupported image type, use jpeg, png or gif")
+var ErrImageTooLarge = errors.New("image too large")
+
+type ProcessedImage struct {
+  ContentType string
+  Width int
+  Height int
+  // JPEG encoded, one per model.ImageSizes entry
+  Sizes map[string][]byte
+}
+
+// Checks the uploaded bytes are an image by their content, not by the name
+// or type the client sent, and creates the smaller sizes
+func ProcessImage(data []byte) (*ProcessedImage, error) {
+  contentType := http.DetectContentType(data)
+  if ! imageTypes[contentType] {
+    return nil, ErrImageType
+  }
+
+  config, _, err := image.DecodeConfig(bytes.NewReader(data))
+  if err != nil {
+    return nil, ErrImageType
+  }
+  if config.Width * config.Height > maxImagePixels {
+    return nil, ErrImageTooLarge
+  }
+
+  img, _, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return nil, ErrImageType
+  }
+
+  // Flatten on white, JPEG has no transparency
+  bounds := img.Bounds()
+  src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(src, src.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+  draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Over)
+
+  result := &ProcessedImage{
+    ContentType: contentType,
+    Width: bounds.Dx(),
+    Height: bounds.Dy(),
+    Sizes: map[string][]byte{},
+  }
+  for name, size := range model.ImageSizes {
+    var buffer bytes.Buffer
+    err = jpeg.Encode(&buffer, fitInto(src, size), &jpeg.Options{Quality: 85})
+    if err != nil {
+      return nil, err
+    }
+    result.Sizes[name] = buffer.Bytes()
+  }
+  return result, nil
+}
+
+// Scales down so the longest side is at most size, averaging all source
+// pixels that fall into a target pixel. Smaller images are kept.
+func fitInto(src *image.RGBA, size int) *image.RGBA {
+  width, height := src.Bounds().Dx(), src.Bounds().Dy()
+  if width <= size && height <= size {
+    return src
+  }
+  dstWidth, dstHeight := size, size
+  if width > height {
+    dstHeight = height * size / width
+  } else {
+    dstWidth = width * size / height
+  }
+  if dstWidth < 1 {
+    dstWidth = 1
+  }
+  if dstHeight < 1 {
+    dstHeight = 1
+  }
+
+  dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+  for y := 0; y < dstHeight; y++ {
+    y0 := y * height / dstHeight
+    y1 := (y + 1) * height / dstHeight
+    if y1 <= y0 {
+      y1 = y0 + 1
+    }
+    for x := 0; x < dstWidth; x++ {
+      x0 := x * width / dstWidth
+      x1 := (x + 1) * width / dstWidth
+      if x1 <= x0 {
+        x1 = x0 + 1
+      }
+      var r, g, b, count int
+      for sy := y0; sy < y1; sy++ {
+        offset := sy * src.Stride + x0 * 4
+        for sx := x0; sx < x1; sx++ {
+          r += int(src.Pix[offset])
+          g += int(src.Pix[offset + 1])
+          b += int(src.Pix[offset + 2])
+          offset += 4
+          count++
+        }
+      }
+      offset := y * dst.Stride + x * 4
+      dst.Pix[offset] = uint8(r / count)
+      dst.Pix[offset + 1] = uint8(g / count)
+      dst.Pix[offset + 2] = uint8(b / count)
+      dst.Pix[offset + 3] = 255
+    }
+  }
+  return dst
+}
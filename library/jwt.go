@@ -10,6 +10,8 @@ import (
   "crypto/rand"
   "crypto/rsa"
   "crypto/x509"
+  "database/sql"
+  "encoding/hex"
   "encoding/pem"
   "errors"
   "io/ioutil"
@@ -78,15 +80,36 @@ func InitJwtKeys() error {
   return nil
 }
 
-func CreateJwtToken(subject, name string) (string, error) {
+const (
+  // Access tokens are short lived, clients renew them with a refresh token
+  AccessTokenLifetime = 15 * time.Minute
+  // Tokens of the deprecated GET /login which has no refresh token
+  LegacyTokenLifetime = 24 * time.Hour
+)
+
+// Creates a signed token with a random jti. A session other than "" is
+// stored as sid claim, it names the refresh token family the token came
+// from.
+func CreateJwtToken(subject, name, role, session string, lifetime time.Duration) (string, error) {
+
+  expires := time.Now().Add(lifetime)
 
-  expires := time.Now().Add(time.Duration(24) * time.Hour)
+  id := make([]byte, 16)
+  _, err := rand.Read(id)
+  if err != nil {
+    return "", err
+  }
 
   claims := jws.Claims{}
+  claims.SetJWTID(hex.EncodeToString(id))
   claims.SetExpiration(expires)
   claims.SetIssuedAt(time.Now())
   claims.SetSubject(subject)
+  if session != "" {
+    claims.Set("sid", session)
+  }
   claims.Set("name", name)
+  claims.Set("role", role)
 
   bytes, err := ioutil.ReadFile("app.rsa")
   if err != nil {
@@ -106,34 +129,124 @@ func CreateJwtToken(subject, name string) (string, error) {
   return string(b), nil
 }
 
+// Claims of a valid token used by the request
+type JwtClaims struct {
+  Subject string
+  ID string
+  Session string
+  IssuedAt time.Time
+  Expires time.Time
+}
+
 func ValidateJwtAndGetSubject(r *http.Request) (string, error) {
+  claims, err := ValidateJwt(r)
+  if err != nil {
+    return "", err
+  }
+  return claims.Subject, nil
+}
+
+// Checks signature, expiry and revocation of the request token
+func ValidateJwt(r *http.Request) (*JwtClaims, error) {
 
   bytes, err := ioutil.ReadFile("app.rsa.pub")
   if err != nil {
-    return "", err
+    return nil, err
   }
   rsaPublic, err := crypto.ParseRSAPublicKeyFromPEM(bytes)
   if err != nil {
-    return "", err
+    return nil, err
   }
 
   jwt, err := jws.ParseJWTFromRequest(r)
   if err != nil {
-    return "", err
+    return nil, err
   }
 
   // Validate token
   if err = jwt.Validate(rsaPublic, crypto.SigningMethodRS256); err != nil {
-    return "", err
+    return nil, err
   }
 
-  if t, set := jwt.Claims().Expiration(); ! set || t.Before(time.Now ()) {
-    return "", err
+  result := &JwtClaims{}
+  claims := jwt.Claims()
+  expires, set := claims.Expiration()
+  if ! set || expires.Before(time.Now ()) {
+    return nil, errors.New("JWT expired")
   }
+  result.Expires = expires
 
-  subject, ok := jwt.Claims().Subject()
+  subject, ok := claims.Subject()
   if ! ok {
-    return "", errors.New("JWT has no subject")
+    return nil, errors.New("JWT has no subject")
   }
-  return subject, nil
+  result.Subject = subject
+
+  // Tokens from before revocation support have no jti and can't be
+  // revoked one by one, they only last until their expiry
+  result.ID, _ = claims.JWTID()
+  result.Session, _ = claims.Get("sid").(string)
+  result.IssuedAt, _ = claims.IssuedAt()
+
+  revoked, err := jwtRevoked(result)
+  if err != nil {
+    return nil, err
+  }
+  if revoked {
+    return nil, errors.New("JWT revoked")
+  }
+  return result, nil
+}
+
+// A token is revoked by a logout of its own or when the refresh token
+// family of its session is revoked. Tokens without a session are revoked
+// when all tokens of the user issued up to a point in time are.
+func jwtRevoked(claims *JwtClaims) (bool, error) {
+  db, tx, err := CreateTransaction()
+  if err != nil {
+    return false, err
+  }
+  defer db.Close()
+  defer tx.Commit()
+
+  var count int
+  if claims.ID != "" {
+    err = tx.QueryRow("SELECT COUNT(*) FROM `revoked_token` WHERE `jti` = ?", claims.ID).Scan(&count)
+    if err != nil || count > 0 {
+      return true, err
+    }
+  }
+
+  if claims.Session != "" {
+    // Dead families are deleted, so look for a live token
+    err = tx.QueryRow("SELECT COUNT(*) FROM `refresh_token` WHERE `family` = ? AND `revoked_at` IS NULL", claims.Session).Scan(&count)
+    return count == 0, err
+  }
+
+  var revokedAt *time.Time
+  err = tx.QueryRow("SELECT `tokens_revoked_at` FROM `user` WHERE `id` = ?", claims.Subject).Scan(&revokedAt)
+  if err == sql.ErrNoRows {
+    return false, nil
+  } else if err != nil {
+    return true, err
+  }
+  // iat only has seconds, a token from the second of the revocation
+  // counts as revoked
+  return revokedAt != nil && ! claims.IssuedAt.After(revokedAt.Truncate(time.Second)), nil
+}
+
+// Revokes a single access token until it expires
+func RevokeJwt(tx *sql.Tx, claims *JwtClaims) error {
+  if claims.ID == "" {
+    return errors.New("JWT has no jti")
+  }
+  _, err := tx.Exec("INSERT OR IGNORE INTO `revoked_token` (`jti`, `expires_at`) VALUES (?, ?)",
+    claims.ID, claims.Expires.UTC())
+  return err
+}
+
+// Forgets revoked tokens that expired anyway
+func DeleteExpiredRevocations(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `revoked_token` WHERE `expires_at` < ?", time.Now().UTC())
+  return err
 }
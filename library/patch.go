@@ -0,0 +1,384 @@
+package library
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+const (
+  MediaMergePatch = "application/merge-patch+json"
+  MediaJsonPatch = "application/json-patch+json"
+)
+
+// A JSON Patch test operation failed, the document is unchanged
+var ErrPatchTest = errors.New("patch test failed")
+
+// The patch is malformed or doesn't fit the document
+type PatchError string
+
+func (err PatchError) Error() string {
+  return string(err)
+}
+
+// Numbers stay json.Number so ids don't lose precision
+func decodeJson(data []byte) (interface{}, error) {
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  var value interface{}
+  err := decoder.Decode(&value)
+  if err != nil {
+    return nil, PatchError("invalid json: " + err.Error())
+  }
+  return value, nil
+}
+
+// Applies a JSON Merge Patch (RFC 7386) to a document
+func MergePatch(doc, patch []byte) ([]byte, error) {
+  target, err := decodeJson(doc)
+  if err != nil {
+    return nil, err
+  }
+  changes, err := decodeJson(patch)
+  if err != nil {
+    return nil, err
+  }
+  return json.Marshal(mergeValue(target, changes))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+  changes, ok := patch.(map[string]interface{})
+  if ! ok {
+    return patch
+  }
+  result, ok := target.(map[string]interface{})
+  if ! ok {
+    result = map[string]interface{}{}
+  }
+  for key, value := range changes {
+    if value == nil {
+      delete(result, key)
+    } else {
+      result[key] = mergeValue(result[key], value)
+    }
+  }
+  return result
+}
+
+// Applies a JSON Patch (RFC 6902) to a document, all operations or none
+func JsonPatch(doc, patch []byte) ([]byte, error) {
+  target, err := decodeJson(doc)
+  if err != nil {
+    return nil, err
+  }
+  decoded, err := decodeJson(patch)
+  if err != nil {
+    return nil, err
+  }
+  operations, ok := decoded.([]interface{})
+  if ! ok {
+    return nil, PatchError("json patch must be an array of operations")
+  }
+
+  for idx, entry := range operations {
+    operation, ok := entry.(map[string]interface{})
+    if ! ok {
+      return nil, PatchError("operation " + strconv.Itoa(idx) + " is no object")
+    }
+    target, err = applyOperation(target, operation)
+    if err != nil {
+      if patchErr, ok := err.(PatchError); ok {
+        return nil, PatchError("operation " + strconv.Itoa(idx) + ": " + string(patchErr))
+      }
+      return nil, err
+    }
+  }
+  return json.Marshal(target)
+}
+
+func applyOperation(doc interface{}, operation map[string]interface{}) (interface{}, error) {
+  op, _ := operation["op"].(string)
+  path, ok := operation["path"].(string)
+  if ! ok {
+    return nil, PatchError("missing path")
+  }
+  tokens, err := parsePointer(path)
+  if err != nil {
+    return nil, err
+  }
+  value, hasValue := operation["value"]
+
+  var fromTokens []string
+  if op == "move" || op == "copy" {
+    from, ok := operation["from"].(string)
+    if ! ok {
+      return nil, PatchError("missing from")
+    }
+    fromTokens, err = parsePointer(from)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  switch op {
+  case "add":
+    if ! hasValue {
+      return nil, PatchError("missing value")
+    }
+    return addValue(doc, tokens, value)
+  case "remove":
+    doc, _, err = removeValue(doc, tokens)
+    return doc, err
+  case "replace":
+    if ! hasValue {
+      return nil, PatchError("missing value")
+    }
+    // Replacing the root is replacing the whole document
+    if len(tokens) > 0 {
+      doc, _, err = removeValue(doc, tokens)
+      if err != nil {
+        return nil, err
+      }
+    }
+    return addValue(doc, tokens, value)
+  case "move":
+    if strings.HasPrefix(path + "/", pointerString(fromTokens) + "/") && len(tokens) > len(fromTokens) {
+      return nil, PatchError("can't move a value into itself")
+    }
+    if pointerString(tokens) == pointerString(fromTokens) {
+      // Moving the root or a value onto itself leaves the document as it is
+      _, err = getValue(doc, fromTokens)
+      if err != nil {
+        return nil, err
+      }
+      return doc, nil
+    }
+    doc, value, err = removeValue(doc, fromTokens)
+    if err != nil {
+      return nil, err
+    }
+    return addValue(doc, tokens, value)
+  case "copy":
+    value, err = getValue(doc, fromTokens)
+    if err != nil {
+      return nil, err
+    }
+    return addValue(doc, tokens, copyValue(value))
+  case "test":
+    if ! hasValue {
+      return nil, PatchError("missing value")
+    }
+    current, err := getValue(doc, tokens)
+    if err != nil || ! jsonEqual(current, value) {
+      return nil, ErrPatchTest
+    }
+    return doc, nil
+  }
+  return nil, PatchError("unknown op " + op)
+}
+
+// Splits a JSON Pointer (RFC 6901), the empty pointer is the whole document
+func parsePointer(pointer string) ([]string, error) {
+  if pointer == "" {
+    return []string{}, nil
+  }
+  if ! strings.HasPrefix(pointer, "/") {
+    return nil, PatchError("invalid pointer " + pointer)
+  }
+  tokens := strings.Split(pointer[1:], "/")
+  for idx, token := range tokens {
+    tokens[idx] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+  }
+  return tokens, nil
+}
+
+func pointerString(tokens []string) string {
+  var pointer strings.Builder
+  for _, token := range tokens {
+    pointer.WriteString("/" + strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1))
+  }
+  return pointer.String()
+}
+
+// Array indexes are plain decimal numbers below size, "-" is the end for add
+func arrayIndex(token string, size int, allowEnd bool) (int, error) {
+  if allowEnd && token == "-" {
+    return size, nil
+  }
+  if token == "" || (len(token) > 1 && token[0] == '0') {
+    return 0, PatchError("invalid array index " + token)
+  }
+  idx, err := strconv.Atoi(token)
+  limit := size - 1
+  if allowEnd {
+    limit = size
+  }
+  if err != nil || idx < 0 || idx > limit {
+    return 0, PatchError("invalid array index " + token)
+  }
+  return idx, nil
+}
+
+func getValue(node interface{}, tokens []string) (interface{}, error) {
+  for _, token := range tokens {
+    switch n := node.(type) {
+    case map[string]interface{}:
+      child, ok := n[token]
+      if ! ok {
+        return nil, PatchError("no value at " + pointerString(tokens))
+      }
+      node = child
+    case []interface{}:
+      idx, err := arrayIndex(token, len(n), false)
+      if err != nil {
+        return nil, err
+      }
+      node = n[idx]
+    default:
+      return nil, PatchError("no value at " + pointerString(tokens))
+    }
+  }
+  return node, nil
+}
+
+// Calls fn with the parent of the location and the last token, the
+// changed parent is stored back into the document
+func changeParent(node interface{}, tokens []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+  if len(tokens) == 1 {
+    return fn(node, tokens[0])
+  }
+  switch n := node.(type) {
+  case map[string]interface{}:
+    child, ok := n[tokens[0]]
+    if ! ok {
+      return nil, PatchError("no value at /" + tokens[0])
+    }
+    changed, err := changeParent(child, tokens[1:], fn)
+    if err != nil {
+      return nil, err
+    }
+    n[tokens[0]] = changed
+    return n, nil
+  case []interface{}:
+    idx, err := arrayIndex(tokens[0], len(n), false)
+    if err != nil {
+      return nil, err
+    }
+    changed, err := changeParent(n[idx], tokens[1:], fn)
+    if err != nil {
+      return nil, err
+    }
+    n[idx] = changed
+    return n, nil
+  }
+  return nil, PatchError("can't descend into /" + tokens[0])
+}
+
+func addValue(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+  if len(tokens) == 0 {
+    return value, nil
+  }
+  return changeParent(doc, tokens, func(parent interface{}, key string) (interface{}, error) {
+    switch p := parent.(type) {
+    case map[string]interface{}:
+      p[key] = value
+      return p, nil
+    case []interface{}:
+      idx, err := arrayIndex(key, len(p), true)
+      if err != nil {
+        return nil, err
+      }
+      p = append(p, nil)
+      copy(p[idx + 1:], p[idx:])
+      p[idx] = value
+      return p, nil
+    }
+    return nil, PatchError("can't add to " + pointerString(tokens))
+  })
+}
+
+func removeValue(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+  if len(tokens) == 0 {
+    return nil, nil, PatchError("can't remove the whole document")
+  }
+  var removed interface{}
+  doc, err := changeParent(doc, tokens, func(parent interface{}, key string) (interface{}, error) {
+    switch p := parent.(type) {
+    case map[string]interface{}:
+      value, ok := p[key]
+      if ! ok {
+        return nil, PatchError("no value at " + pointerString(tokens))
+      }
+      removed = value
+      delete(p, key)
+      return p, nil
+    case []interface{}:
+      idx, err := arrayIndex(key, len(p), false)
+      if err != nil {
+        return nil, err
+      }
+      removed = p[idx]
+      return append(p[:idx], p[idx + 1:]...), nil
+    }
+    return nil, PatchError("no value at " + pointerString(tokens))
+  })
+  return doc, removed, err
+}
+
+func copyValue(value interface{}) interface{} {
+  switch v := value.(type) {
+  case map[string]interface{}:
+    result := make(map[string]interface{}, len(v))
+    for key, child := range v {
+      result[key] = copyValue(child)
+    }
+    return result
+  case []interface{}:
+    result := make([]interface{}, len(v))
+    for idx, child := range v {
+      result[idx] = copyValue(child)
+    }
+    return result
+  }
+  return value
+}
+
+// Compares decoded JSON, numbers by value so 1 equals 1.0
+func jsonEqual(a, b interface{}) bool {
+  switch x := a.(type) {
+  case json.Number:
+    y, ok := b.(json.Number)
+    if ! ok {
+      return false
+    }
+    fx, errX := x.Float64()
+    fy, errY := y.Float64()
+    return errX == nil && errY == nil && fx == fy
+  case map[string]interface{}:
+    y, ok := b.(map[string]interface{})
+    if ! ok || len(x) != len(y) {
+      return false
+    }
+    for key, value := range x {
+      other, ok := y[key]
+      if ! ok || ! jsonEqual(value, other) {
+        return false
+      }
+    }
+    return true
+  case []interface{}:
+    y, ok := b.([]interface{})
+    if ! ok || len(x) != len(y) {
+      return false
+    }
+    for idx := range x {
+      if ! jsonEqual(x[idx], y[idx]) {
+        return false
+      }
+    }
+    return true
+  }
+  return a == b
+}
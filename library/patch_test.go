@@ -0,0 +1,136 @@
+package library
+
+import (
+  "encoding/json"
+  "reflect"
+  "testing"
+)
+
+func sameJson(t *testing.T, got []byte, want string) bool {
+  var a, b interface{}
+  if err := json.Unmarshal(got, &a); err != nil {
+    t.Fatal(err)
+  }
+  if err := json.Unmarshal([]byte(want), &b); err != nil {
+    t.Fatal(err)
+  }
+  return reflect.DeepEqual(a, b)
+}
+
+// The examples of RFC 7386 appendix A
+func TestMergePatch(t *testing.T) {
+  tests := []struct {
+    doc, patch, want string
+  }{
+    {`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+    {`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+    {`{"a":"b"}`, `{"a":null}`, `{}`},
+    {`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+    {`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+    {`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+    {`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+    {`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+    {`["a","b"]`, `["c","d"]`, `["c","d"]`},
+    {`{"a":"b"}`, `["c"]`, `["c"]`},
+    {`{"a":"foo"}`, `null`, `null`},
+    {`{"a":"foo"}`, `"bar"`, `"bar"`},
+    {`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+    {`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+    {`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+  }
+
+  for _, test := range tests {
+    got, err := MergePatch([]byte(test.doc), []byte(test.patch))
+    if err != nil {
+      t.Errorf("%s + %s: %v", test.doc, test.patch, err)
+    } else if ! sameJson(t, got, test.want) {
+      t.Errorf("%s + %s = %s, want %s", test.doc, test.patch, got, test.want)
+    }
+  }
+}
+
+// The examples of RFC 6902 appendix A and operations on the root pointer,
+// an empty want means the patch has to fail
+func TestJsonPatch(t *testing.T) {
+  tests := []struct {
+    name, doc, patch, want string
+  }{
+    {"A.1 add object member", `{"foo":"bar"}`,
+      `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+    {"A.2 add array element", `{"foo":["bar","baz"]}`,
+      `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+    {"A.3 remove object member", `{"baz":"qux","foo":"bar"}`,
+      `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+    {"A.4 remove array element", `{"foo":["bar","qux","baz"]}`,
+      `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+    {"A.5 replace", `{"baz":"qux","foo":"bar"}`,
+      `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+    {"A.6 move value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+      `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+      `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+    {"A.7 move array element", `{"foo":["all","grass","cows","eat"]}`,
+      `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+    {"A.8 test", `{"baz":"qux","foo":["a",2,"c"]}`,
+      `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+      `{"baz":"qux","foo":["a",2,"c"]}`},
+    {"A.9 failed test", `{"baz":"qux"}`,
+      `[{"op":"test","path":"/baz","value":"bar"}]`, ``},
+    {"A.10 add nested member", `{"foo":"bar"}`,
+      `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+    {"A.11 ignore unknown members", `{"foo":"bar"}`,
+      `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, `{"foo":"bar","baz":"qux"}`},
+    {"A.12 add to missing target", `{"foo":"bar"}`,
+      `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``},
+    {"A.14 escape ordering", `{"/":9,"~1":10}`,
+      `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+    {"A.15 string is no number", `{"/":9,"~1":10}`,
+      `[{"op":"test","path":"/~01","value":"10"}]`, ``},
+    {"A.16 add array value", `{"foo":["bar"]}`,
+      `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+    {"add root", `{"foo":"bar"}`,
+      `[{"op":"add","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+    {"replace root", `{"foo":"bar"}`,
+      `[{"op":"replace","path":"","value":[1,2]}]`, `[1,2]`},
+    {"move into root", `{"foo":{"bar":1}}`,
+      `[{"op":"move","from":"/foo","path":""}]`, `{"bar":1}`},
+    {"move root onto itself", `{"foo":"bar"}`,
+      `[{"op":"move","from":"","path":""}]`, `{"foo":"bar"}`},
+    {"move root into child", `{"foo":{}}`,
+      `[{"op":"move","from":"","path":"/foo/bar"}]`, ``},
+    {"move value onto itself", `{"foo":"bar"}`,
+      `[{"op":"move","from":"/foo","path":"/foo"}]`, `{"foo":"bar"}`},
+    {"copy", `{"foo":{"bar":1}}`,
+      `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`,
+      `{"foo":{"bar":1},"baz":{"bar":2}}`},
+    {"test root", `{"foo":1.0}`,
+      `[{"op":"test","path":"","value":{"foo":1}}]`, `{"foo":1}`},
+    {"remove root", `{"foo":"bar"}`,
+      `[{"op":"remove","path":""}]`, ``},
+    {"replace missing", `{"foo":"bar"}`,
+      `[{"op":"replace","path":"/baz","value":1}]`, ``},
+    {"array index with leading zero", `{"foo":[1,2]}`,
+      `[{"op":"remove","path":"/foo/01"}]`, ``},
+    {"all or nothing", `{"foo":"bar"}`,
+      `[{"op":"add","path":"/baz","value":1},{"op":"remove","path":"/missing"}]`, ``},
+  }
+
+  for _, test := range tests {
+    got, err := JsonPatch([]byte(test.doc), []byte(test.patch))
+    if test.want == "" {
+      if err == nil {
+        t.Errorf("%s: got %s, want an error", test.name, got)
+      }
+    } else if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+    } else if ! sameJson(t, got, test.want) {
+      t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+    }
+  }
+}
+
+func TestJsonPatchFailedTest(t *testing.T) {
+  _, err := JsonPatch([]byte(`{"baz":"qux"}`), []byte(`[{"op":"test","path":"/baz","value":"bar"}]`))
+  if err != ErrPatchTest {
+    t.Errorf("got %v, want ErrPatchTest", err)
+  }
+}
@@ -0,0 +1,96 @@
+package library
+
+import (
+  "errors"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// Where uploaded files like recipe images are kept, keys are slash
+// separated paths like "recipe/1/image/2/original"
+type Storage interface {
+  Save(key string, data []byte) error
+  Open(key string) (io.ReadCloser, error)
+  Delete(key string) error
+}
+
+var ErrStorageKey = errors.New("invalid storage key")
+
+var ImageStorage Storage
+
+func InitImageStorage(dir string) error {
+  storage, err := NewFileStorage(dir)
+  if err != nil {
+    return err
+  }
+  log.Printf("Store images in %s\n", dir)
+  ImageStorage = storage
+  return nil
+}
+
+// Stores files below a directory of the local file system
+type FileStorage struct {
+  dir string
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+  err := os.MkdirAll(dir, 0755)
+  if err != nil {
+    return nil, err
+  }
+  return &FileStorage{dir: dir}, nil
+}
+
+func (storage *FileStorage) path(key string) (string, error) {
+  if key == "" || strings.HasPrefix(key, "/") {
+    return "", ErrStorageKey
+  }
+  for _, part := range strings.Split(key, "/") {
+    if part == "" || part == "." || part == ".." {
+      return "", ErrStorageKey
+    }
+  }
+  return filepath.Join(storage.dir, filepath.FromSlash(key)), nil
+}
+
+func (storage *FileStorage) Save(key string, data []byte) error {
+  path, err := storage.path(key)
+  if err != nil {
+    return err
+  }
+  err = os.MkdirAll(filepath.Dir(path), 0755)
+  if err != nil {
+    return err
+  }
+  // Write to a temporary file first so readers never see half a file
+  tmp := path + ".tmp"
+  err = ioutil.WriteFile(tmp, data, 0644)
+  if err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+func (storage *FileStorage) Open(key string) (io.ReadCloser, error) {
+  path, err := storage.path(key)
+  if err != nil {
+    return nil, err
+  }
+  return os.Open(path)
+}
+
+func (storage *FileStorage) Delete(key string) error {
+  path, err := storage.path(key)
+  if err != nil {
+    return err
+  }
+  err = os.Remove(path)
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
@@ -1,11 +1,23 @@
+// Recipe API server. Recipe search uses the FTS5 module of SQLite, which
+// go-sqlite3 only includes when built with
+//
+//   go build -tags sqlite_fts5
+//
+// The server refuses to start without it unless SEARCH=off is set.
 package main
 
 import (
   "log"
+  "net"
   "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
   "github.com/gorilla/mux"
   "github.com/hc42/food-api/api"
   "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
 )
 
 func Init() {
@@ -13,10 +25,87 @@ func Init() {
   if err != nil {
     log.Fatal(err)
   }
+  // Recipe search needs SQLite with FTS5, SEARCH=off runs without it
   err = library.InitDb()
+  if err == library.ErrNoFts5 && os.Getenv("SEARCH") == "off" {
+    log.Println("Recipe search disabled")
+  } else if err != nil {
+    log.Fatal(err)
+  }
+  err = library.InitImageStorage("images")
   if err != nil {
     log.Fatal(err)
   }
+
+  // Recipes stay in the trash for 30 days unless TRASH_RETENTION is set
+  // to a duration like "168h"
+  retention := durationEnv("TRASH_RETENTION", 30 * 24 * time.Hour)
+  api.StartTrashPurge(retention, time.Hour)
+
+  // Failed logins are limited per account and client address. Behind a
+  // reverse proxy set LOGIN_TRUSTED_PROXIES to its addresses or networks,
+  // like "10.0.0.1,172.16.0.0/12", so the client address is taken from
+  // Forwarded or X-Forwarded-For. Without it every login seems to come from
+  // the proxy and one client can lock out all others.
+  api.SetTrustedProxies(networksEnv("LOGIN_TRUSTED_PROXIES"))
+  policy := model.DefaultLoginPolicy
+  policy.MaxFailures = intEnv("LOGIN_MAX_FAILURES", policy.MaxFailures)
+  policy.MaxAddressFailures = intEnv("LOGIN_MAX_ADDRESS_FAILURES", policy.MaxAddressFailures)
+  policy.Backoff = durationEnv("LOGIN_BACKOFF", policy.Backoff)
+  policy.MaxBackoff = durationEnv("LOGIN_MAX_BACKOFF", policy.MaxBackoff)
+  policy.Lockout = durationEnv("LOGIN_LOCKOUT", policy.Lockout)
+  policy.Window = durationEnv("LOGIN_FAILURE_WINDOW", policy.Window)
+  api.SetLoginPolicy(policy)
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+  v := os.Getenv(name)
+  if v == "" {
+    return fallback
+  }
+  d, err := time.ParseDuration(v)
+  if err != nil || d < 0 {
+    log.Fatal("invalid " + name + ": ", v)
+  }
+  return d
+}
+
+func intEnv(name string, fallback int) int {
+  v := os.Getenv(name)
+  if v == "" {
+    return fallback
+  }
+  n, err := strconv.Atoi(v)
+  if err != nil || n < 1 {
+    log.Fatal("invalid " + name + ": ", v)
+  }
+  return n
+}
+
+// Comma separated addresses and CIDR networks
+func networksEnv(name string) []*net.IPNet {
+  list := []*net.IPNet{}
+  for _, v := range strings.Split(os.Getenv(name), ",") {
+    v = strings.TrimSpace(v)
+    if v == "" {
+      continue
+    }
+    if ip := net.ParseIP(v); ip != nil {
+      bits := 8 * net.IPv6len
+      if ip.To4() != nil {
+        ip = ip.To4()
+        bits = 8 * net.IPv4len
+      }
+      list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+      continue
+    }
+    _, network, err := net.ParseCIDR(v)
+    if err != nil {
+      log.Fatal("invalid " + name + ": ", v)
+    }
+    list = append(list, network)
+  }
+  return list
 }
 
 func main() {
@@ -24,19 +113,45 @@ func main() {
 
   router := mux.NewRouter()
   router.HandleFunc("/recipes", api.ListRecipes).Methods("GET")
+  router.HandleFunc("/recipes/search", api.SearchRecipes).Methods("GET")
   router.HandleFunc("/recipes/{id:[0-9]+}", api.GetRecipe).Methods("GET")
-  router.HandleFunc("/recipes/{id:[0-9]+}", api.RequireLogin(api.DeleteRecipe)).Methods("DELETE")
-  router.HandleFunc("/recipes/{id:[0-9]+}", api.RequireLogin(api.UpdateRecipe)).Methods("PUT")
-  router.HandleFunc("/recipes", api.RequireLogin(api.CreateRecipe)).Methods("POST")
-  router.HandleFunc("/login", api.UserLogin).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}.cook", api.GetRecipeCooklang).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}", api.RequireRole(model.RoleEditor, api.DeleteRecipe)).Methods("DELETE")
+  router.HandleFunc("/recipes/{id:[0-9]+}", api.RequireRole(model.RoleEditor, api.UpdateRecipe)).Methods("PUT", "PATCH")
+  router.HandleFunc("/recipes", api.RequireRole(model.RoleEditor, api.CreateRecipe)).Methods("POST")
+  router.HandleFunc("/recipes/import/schemaorg", api.RequireRole(model.RoleEditor, api.ImportSchemaRecipe)).Methods("POST")
+  router.HandleFunc("/recipes/import/cooklang", api.RequireRole(model.RoleEditor, api.ImportCooklangRecipe)).Methods("POST")
+  router.HandleFunc("/recipes/{id:[0-9]+}/revisions", api.RequireRole(model.RoleViewer, api.ListRevisions)).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}/revisions/diff", api.RequireRole(model.RoleViewer, api.DiffRevisions)).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}/revisions/{rev:[0-9]+}", api.RequireRole(model.RoleViewer, api.GetRevision)).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}/revisions/{rev:[0-9]+}/restore", api.RequireRole(model.RoleEditor, api.RestoreRevision)).Methods("POST")
+  router.HandleFunc("/recipes/{id:[0-9]+}/images", api.RequireRole(model.RoleEditor, api.UploadRecipeImage)).Methods("POST")
+  router.HandleFunc("/recipes/{id:[0-9]+}/images/{imageId:[0-9]+}", api.GetRecipeImage).Methods("GET")
+  router.HandleFunc("/recipes/{id:[0-9]+}/images/{imageId:[0-9]+}", api.RequireRole(model.RoleEditor, api.DeleteRecipeImage)).Methods("DELETE")
+  router.HandleFunc("/tags", api.ListTags).Methods("GET")
+  router.HandleFunc("/trash", api.RequireRole(model.RoleEditor, api.ListTrash)).Methods("GET")
+  router.HandleFunc("/trash/{id:[0-9]+}/restore", api.RequireRole(model.RoleEditor, api.RestoreTrash)).Methods("POST")
+  router.HandleFunc("/export", api.RequireRole(model.RoleAdmin, api.ExportRecipes)).Methods("GET")
+  router.HandleFunc("/import", api.RequireRole(model.RoleAdmin, api.ImportRecipes)).Methods("POST")
+  router.HandleFunc("/auth/login", api.Login).Methods("POST")
+  router.HandleFunc("/auth/refresh", api.RefreshToken).Methods("POST")
+  router.HandleFunc("/auth/logout", api.RequireLogin(api.Logout)).Methods("POST")
+  router.HandleFunc("/auth/logout-all", api.RequireLogin(api.LogoutAll)).Methods("POST")
+  router.HandleFunc("/auth/lockouts", api.RequireRole(model.RoleAdmin, api.ListLockouts)).Methods("GET")
+  router.HandleFunc("/auth/lockouts/{id:[0-9]+}", api.RequireRole(model.RoleAdmin, api.ClearLockout)).Methods("DELETE")
+  // The old GET /login puts credentials into the query string, it stays
+  // available until LEGACY_LOGIN=off
+  if os.Getenv("LEGACY_LOGIN") != "off" {
+    router.HandleFunc("/login", api.UserLogin).Methods("GET")
+  }
   router.HandleFunc("/self", api.RequireLogin(api.GetSelf)).Methods("GET")
-  router.HandleFunc("/self", api.RequireLogin(api.UpdateSelf)).Methods("PUT")
+  router.HandleFunc("/self", api.RequireLogin(api.UpdateSelf)).Methods("PUT", "PATCH")
   router.HandleFunc("/self/setPassword", api.RequireLogin(api.SetPassword)).Methods("POST")
-  router.HandleFunc("/user", api.RequireLogin(api.CreateUser)).Methods("POST")
-  router.HandleFunc("/user", api.RequireLogin(api.ListUsers)).Methods("GET")
-  router.HandleFunc("/user/{id:[0-9]+}", api.RequireLogin(api.GetUser)).Methods("GET")
-  router.HandleFunc("/user/{id:[0-9]+}", api.RequireLogin(api.DeleteUser)).Methods("DELETE")
-  router.HandleFunc("/user/{id:[0-9]+}", api.RequireLogin(api.UpdateUser)).Methods("PUT")
+  router.HandleFunc("/user", api.RequireRole(model.RoleAdmin, api.CreateUser)).Methods("POST")
+  router.HandleFunc("/user", api.RequireRole(model.RoleAdmin, api.ListUsers)).Methods("GET")
+  router.HandleFunc("/user/{id:[0-9]+}", api.RequireRole(model.RoleAdmin, api.GetUser)).Methods("GET")
+  router.HandleFunc("/user/{id:[0-9]+}", api.RequireRole(model.RoleAdmin, api.DeleteUser)).Methods("DELETE")
+  router.HandleFunc("/user/{id:[0-9]+}", api.RequireRole(model.RoleAdmin, api.UpdateUser)).Methods("PUT", "PATCH")
   router.NotFoundHandler = http.HandlerFunc(api.NotFound)
   log.Fatal(http.ListenAndServe(":8000", router))
 }
@@ -0,0 +1,142 @@
+package model
+
+import (
+  "database/sql"
+  "errors"
+  "time"
+)
+
+// What to do with an archived recipe whose id already exists
+const (
+  ImportSkip = "skip"
+  ImportOverwrite = "overwrite"
+  ImportDuplicate = "duplicate"
+)
+
+type ImportResult struct {
+  Created int `json:"created"`
+  Overwritten int `json:"overwritten"`
+  Skipped int `json:"skipped"`
+}
+
+func ValidImportStrategy(strategy string) bool {
+  return strategy == ImportSkip || strategy == ImportOverwrite || strategy == ImportDuplicate
+}
+
+// Calls fn for every recipe not in the trash in id order, loading idBatchSize recipes at a
+// time so the whole database is never in memory
+func ForEachRecipe(tx *sql.Tx, fn func(recipe *Recipe) error) error {
+  var after int64
+  for {
+    list, err := queryRecipes(tx,
+      "SELECT " + recipeColumns + " FROM `recipe` WHERE `recipe`.`id` > ? AND " + recipeLive + " ORDER BY `recipe`.`id` LIMIT ?",
+      after, idBatchSize)
+    if err != nil {
+      return err
+    }
+    for idx := range list {
+      err = fn(&list[idx])
+      if err != nil {
+        return err
+      }
+    }
+    if len(list) < idBatchSize {
+      return nil
+    }
+    after = list[len(list) - 1].ID
+  }
+}
+
+// Ingredient and step ids of an archive belong to the exporting instance.
+// Steps keep their ingredients by position and get new ids when stored.
+func (recipe *Recipe)resetRelationIds() {
+  positions := map[int64]int{}
+  for idx := range recipe.Ingredients {
+    positions[recipe.Ingredients[idx].ID] = idx
+    recipe.Ingredients[idx].ID = 0
+  }
+  for idx := range recipe.Steps {
+    step := &(recipe.Steps[idx])
+    step.ingredientRefs = []int{}
+    for _, id := range step.Ingredients {
+      if position, ok := positions[id]; ok {
+        step.ingredientRefs = append(step.ingredientRefs, position)
+      }
+    }
+    step.ID = 0
+    step.Ingredients = nil
+  }
+  // Image files are not part of an archive
+  recipe.Images = []Image{}
+}
+
+// Stores a recipe of an archive. New recipes keep their id, creator and
+// creation time if possible, userId is the creator otherwise. Overwritten
+// recipes keep creator and images and are taken out of the trash.
+func (recipe *Recipe)Import(tx *sql.Tx, strategy string, userId int64, result *ImportResult) error {
+  if ! ValidImportStrategy(strategy) {
+    return errors.New("invalid import strategy " + strategy)
+  }
+  recipe.resetRelationIds()
+  now := time.Now().UTC()
+
+  var existing *Recipe
+  trashed := false
+  if recipe.ID > 0 {
+    var err error
+    existing, err = GetRecipeById(tx, recipe.ID)
+    if err == sql.ErrNoRows {
+      existing, err = GetTrashedRecipe(tx, recipe.ID)
+      trashed = err == nil
+    }
+    if err == sql.ErrNoRows {
+      existing = nil
+    } else if err != nil {
+      return err
+    }
+  }
+
+  if existing != nil {
+    switch strategy {
+    case ImportSkip:
+      result.Skipped++
+      return nil
+    case ImportOverwrite:
+      if trashed {
+        err := existing.clearTrash(tx)
+        if err != nil {
+          return err
+        }
+      }
+      recipe.CreatedBy = existing.CreatedBy
+      recipe.CreatedAt = existing.CreatedAt
+      recipe.UpdatedBy = userId
+      recipe.Images = existing.Images
+      recipe.Version = existing.Version
+      err := recipe.Update(tx)
+      if err != nil {
+        return err
+      }
+      result.Overwritten++
+      return nil
+    }
+    recipe.ID = 0
+  } else if recipe.ID < 0 {
+    recipe.ID = 0
+  }
+
+  if _, err := GetUser(tx, recipe.CreatedBy); err != nil {
+    recipe.CreatedBy = userId
+  }
+  recipe.UpdatedBy = userId
+  if recipe.CreatedAt.IsZero() {
+    recipe.CreatedAt = now
+  }
+  recipe.UpdatedAt = now
+  err := recipe.insert(tx, RevisionCreate)
+  if err != nil {
+    return err
+  }
+  result.Created++
+  return nil
+}
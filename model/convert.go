@@ -0,0 +1,177 @@
+package model
+
+import (
+  "errors"
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+const UnitsOriginal = "original"
+
+// Grams per milliliter of ingredients commonly given by volume in one system
+// and by weight in the other. Longer names first so "brown sugar" wins over
+// "sugar".
+type density struct {
+  name string
+  gramsPerMl float64
+}
+
+var densities = []density{
+  {"powdered sugar", 0.51},
+  {"icing sugar", 0.51},
+  {"brown sugar", 0.93},
+  {"bread flour", 0.55},
+  {"cocoa powder", 0.42},
+  {"baking powder", 0.81},
+  {"baking soda", 0.92},
+  {"rolled oats", 0.38},
+  {"cornstarch", 0.54},
+  {"breadcrumbs", 0.46},
+  {"parmesan", 0.42},
+  {"almonds", 0.6},
+  {"walnuts", 0.5},
+  {"raisins", 0.63},
+  {"butter", 0.96},
+  {"flour", 0.53},
+  {"sugar", 0.85},
+  {"honey", 1.42},
+  {"cocoa", 0.42},
+  {"oats", 0.38},
+  {"rice", 0.78},
+  {"salt", 1.22},
+}
+
+func lookupDensity(ingredientName string) (float64, bool) {
+  name := strings.ToLower(ingredientName)
+  for _, d := range densities {
+    if strings.Contains(name, d.name) {
+      return d.gramsPerMl, true
+    }
+  }
+  return 0, false
+}
+
+func ValidUnitSystem(system string) bool {
+  return system == "" || system == UnitsOriginal || system == SystemMetric || system == SystemImperial
+}
+
+// Converts amount and unit of an ingredient to the given system. Units that
+// belong to no system, like spoons and counts, stay as they are.
+func ConvertAmount(amount float64, unitName, ingredientName, system string) (float64, string, bool) {
+  unit, ok := LookupUnit(unitName)
+  if ! ok || unit.System == "" || unit.System == system || unit.Dimension == DimensionCount {
+    return amount, unitName, false
+  }
+  base := amount * unit.Factor
+  gramsPerMl, hasDensity := lookupDensity(ingredientName)
+
+  var target string
+  if system == SystemMetric {
+    if unit.Dimension == DimensionVolume && hasDensity {
+      base = base * gramsPerMl
+      target = metricMassUnit(base)
+    } else if unit.Dimension == DimensionMass {
+      target = metricMassUnit(base)
+    } else {
+      target = metricVolumeUnit(base)
+    }
+  } else {
+    if unit.Dimension == DimensionMass && hasDensity {
+      base = base / gramsPerMl
+      target = imperialVolumeUnit(base)
+    } else if unit.Dimension == DimensionMass {
+      target = imperialMassUnit(base)
+    } else {
+      target = imperialVolumeUnit(base)
+    }
+  }
+
+  targetUnit, _ := LookupUnit(target)
+  return RoundAmount(base / targetUnit.Factor, target), target, true
+}
+
+func metricMassUnit(grams float64) string {
+  if grams >= 1000 {
+    return "kg"
+  }
+  return "g"
+}
+
+func metricVolumeUnit(ml float64) string {
+  if ml >= 1000 {
+    return "l"
+  }
+  return "ml"
+}
+
+func imperialMassUnit(grams float64) string {
+  if grams >= 453.59237 {
+    return "lb"
+  }
+  return "oz"
+}
+
+func imperialVolumeUnit(ml float64) string {
+  switch {
+  case ml < 14.78676478125:
+    return "tsp"
+  case ml < 59.1470591:
+    return "tbsp"
+  case ml < 946.352946:
+    return "cup"
+  }
+  return "qt"
+}
+
+// Temperatures in descriptions are tagged like {180°C} or {350 °F}
+var temperatureTag = regexp.MustCompile(`\{\s*(-?[0-9]+(?:[.,][0-9]+)?)\s*°?\s*([CFcf])\s*\}`)
+
+// Replaces temperature tags with the temperature in the given system
+func ConvertTemperatures(text, system string) string {
+  return temperatureTag.ReplaceAllStringFunc(text, func(tag string) string {
+    match := temperatureTag.FindStringSubmatch(tag)
+    value, err := strconv.ParseFloat(strings.Replace(match[1], ",", ".", 1), 64)
+    if err != nil {
+      return tag
+    }
+    scale := strings.ToUpper(match[2])
+    if system == SystemMetric && scale == "F" {
+      value = (value - 32) * 5 / 9
+      scale = "C"
+    } else if system == SystemImperial && scale == "C" {
+      value = value * 9 / 5 + 32
+      scale = "F"
+    } else {
+      return FormatAmount(value) + " °" + scale
+    }
+    return strconv.Itoa(int(math.Round(value / 5) * 5)) + " °" + scale
+  })
+}
+
+// Converts ingredients and tagged temperatures for output, original keeps
+// the recipe as stored. Don't store the result.
+func (recipe *Recipe)ConvertUnits(system string) error {
+  if ! ValidUnitSystem(system) {
+    return errors.New("invalid unit system " + system)
+  }
+  if system == "" || system == UnitsOriginal {
+    return nil
+  }
+  for idx := range recipe.Ingredients {
+    ingredient := &(recipe.Ingredients[idx])
+    if ingredient.Amount == nil {
+      continue
+    }
+    amount, unit, converted := ConvertAmount(*(ingredient.Amount), ingredient.Unit, ingredient.Name, system)
+    if ! converted {
+      continue
+    }
+    ingredient.Amount = &amount
+    ingredient.Unit = unit
+    ingredient.Quantity = Quantity{amount, unit, ingredient.Note}.String()
+  }
+  recipe.Description = ConvertTemperatures(recipe.Description, system)
+  return nil
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+  "math"
+  "testing"
+)
+
+func TestConvertAmount(t *testing.T) {
+  tests := []struct {
+    amount float64
+    unit string
+    name string
+    system string
+    wantAmount float64
+    wantUnit string
+    converted bool
+  }{
+    // Volume to weight with the density of the ingredient
+    {1, "cup", "flour", SystemMetric, 125, "g", true},
+    {1, "cup", "brown sugar", SystemMetric, 220, "g", true},
+    {1, "cup", "sugar", SystemMetric, 201, "g", true},
+    {500, "g", "butter", SystemImperial, 2.25, "cup", true},
+
+    // Same dimension without density
+    {1, "cup", "milk", SystemMetric, 237, "ml", true},
+    {8, "oz", "cheese", SystemMetric, 227, "g", true},
+    {3, "lb", "potatoes", SystemMetric, 1.4, "kg", true},
+    {100, "g", "potatoes", SystemImperial, 3.5, "oz", true},
+    {500, "g", "potatoes", SystemImperial, 1, "lb", true},
+    {1, "l", "milk", SystemImperial, 1, "qt", true},
+    {10, "ml", "vanilla", SystemImperial, 2, "tsp", true},
+
+    // Already in the system, no system, counts and unknown units
+    {200, "g", "flour", SystemMetric, 200, "g", false},
+    {2, "cup", "flour", SystemImperial, 2, "cup", false},
+    {2, "tbsp", "oil", SystemMetric, 2, "tbsp", false},
+    {3, "clove", "garlic", SystemMetric, 3, "clove", false},
+    {2, "smidgen", "salt", SystemMetric, 2, "smidgen", false},
+    {2, "", "eggs", SystemImperial, 2, "", false},
+  }
+
+  for _, test := range tests {
+    amount, unit, converted := ConvertAmount(test.amount, test.unit, test.name, test.system)
+    if converted != test.converted || unit != test.wantUnit || math.Abs(amount - test.wantAmount) > 1e-9 {
+      t.Errorf("ConvertAmount(%v %s %s, %s) = %v %s %v, want %v %s %v", test.amount, test.unit, test.name,
+        test.system, amount, unit, converted, test.wantAmount, test.wantUnit, test.converted)
+    }
+  }
+}
+
+func TestRoundAmount(t *testing.T) {
+  tests := []struct {
+    amount float64
+    unit string
+    want float64
+  }{
+    {0.3, "cup", 0.25},
+    {0.05, "cup", 0.25},
+    {1.1, "tsp", 1.125},
+    {3.3, "pinch", 3},
+    {2.4, "", 2.5},
+    {0.1, "", 0.5},
+    {1234, "g", 1235},
+    {12.6, "g", 13},
+    {0.123, "g", 0.12},
+    {7.04, "smidgen", 7},
+  }
+
+  for _, test := range tests {
+    if got := RoundAmount(test.amount, test.unit); math.Abs(got - test.want) > 1e-9 {
+      t.Errorf("RoundAmount(%v, %q) = %v, want %v", test.amount, test.unit, got, test.want)
+    }
+  }
+}
+
+func TestConvertTemperatures(t *testing.T) {
+  tests := []struct {
+    text string
+    system string
+    want string
+  }{
+    {"Bake at {180°C}.", SystemImperial, "Bake at 355 °F."},
+    {"Bake at {350 °F}.", SystemMetric, "Bake at 175 °C."},
+    {"{ 200,5 c }", SystemImperial, "395 °F"},
+    {"Bake at {180°C}.", SystemMetric, "Bake at 180 °C."},
+    {"From {20°C} to {100°C}", SystemImperial, "From 70 °F to 210 °F"},
+    {"Heat to 180°C or {hot}", SystemImperial, "Heat to 180°C or {hot}"},
+  }
+
+  for _, test := range tests {
+    if got := ConvertTemperatures(test.text, test.system); got != test.want {
+      t.Errorf("ConvertTemperatures(%q, %s) = %q, want %q", test.text, test.system, got, test.want)
+    }
+  }
+}
+
+func TestConvertUnits(t *testing.T) {
+  cup, two := 1.0, 2.0
+  newRecipe := func() *Recipe {
+    return &Recipe{
+      Description: "Bake at {350°F}.",
+      Ingredients: []Ingredient{
+        {Name: "flour", Quantity: "1 cup, sifted", Amount: &cup, Unit: "cup", Note: "sifted"},
+        {Name: "eggs", Quantity: "2", Amount: &two},
+        {Name: "salt", Quantity: "to taste"},
+      },
+    }
+  }
+
+  recipe := newRecipe()
+  err := recipe.ConvertUnits(SystemMetric)
+  if err != nil {
+    t.Fatal(err)
+  }
+  flour := recipe.Ingredients[0]
+  if *(flour.Amount) != 125 || flour.Unit != "g" || flour.Quantity != "125 g, sifted" {
+    t.Errorf("flour = %v %s %q, want 125 g \"125 g, sifted\"", *(flour.Amount), flour.Unit, flour.Quantity)
+  }
+  if eggs := recipe.Ingredients[1]; *(eggs.Amount) != 2 || eggs.Unit != "" || eggs.Quantity != "2" {
+    t.Errorf("eggs changed to %v %s %q", *(eggs.Amount), eggs.Unit, eggs.Quantity)
+  }
+  if salt := recipe.Ingredients[2]; salt.Amount != nil || salt.Quantity != "to taste" {
+    t.Errorf("salt changed to %q", salt.Quantity)
+  }
+  if recipe.Description != "Bake at 175 °C." {
+    t.Errorf("description = %q", recipe.Description)
+  }
+
+  for _, system := range []string{"", UnitsOriginal} {
+    recipe = newRecipe()
+    err = recipe.ConvertUnits(system)
+    if err != nil || recipe.Ingredients[0].Unit != "cup" || recipe.Description != "Bake at {350°F}." {
+      t.Errorf("ConvertUnits(%q) changed the recipe", system)
+    }
+  }
+
+  if err = newRecipe().ConvertUnits("si"); err == nil {
+    t.Error("ConvertUnits(\"si\") accepted an unknown system")
+  }
+}
@@ -0,0 +1,395 @@
+package model
+
+import (
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// Ingredients @name or @multi word name{qty%unit}(note), cookware #pot or
+// #large pot{} and timers ~{25%minutes} or ~name{25%minutes}
+var cooklangToken = regexp.MustCompile(`([@#~])(?:([^@#~{}\n]*?)\{([^{}]*)\}(?:\(([^()]*)\))?|([\p{L}\p{N}_\-]+))`)
+var cooklangBlockComment = regexp.MustCompile(`(?s)\[-.*?-\]`)
+var cooklangWord = regexp.MustCompile(`^[\p{L}\p{N}_\-]+$`)
+var cooklangDuration = regexp.MustCompile(`(?i)([0-9]+(?:[.,][0-9]+)?)\s*([a-z]+)?`)
+var cooklangTimerText = regexp.MustCompile(`(?i)\b([0-9]+(?:[.,][0-9]+)?)\s*(seconds?|secs?|minutes?|mins?|hours?|hrs?|days?)\b`)
+
+var cooklangEscaper = strings.NewReplacer("\\", "\\\\", "@", "\\@", "#", "\\#", "~", "\\~")
+
+var timeUnits = map[string]float64{
+  "s": 1, "sec": 1, "secs": 1, "second": 1, "seconds": 1,
+  "m": 60, "min": 60, "mins": 60, "minute": 60, "minutes": 60,
+  "h": 3600, "hr": 3600, "hrs": 3600, "hour": 3600, "hours": 3600,
+  "d": 86400, "day": 86400, "days": 86400,
+}
+
+// Parses a Cooklang recipe. Metadata comes from ">> key: value" lines or
+// front matter, "> " notes become the description and every paragraph a
+// step. Timers add up to the step duration. Recipes have no cookware, so
+// cookware is dropped on purpose: only its name stays in the step text and
+// an export won't mark it again. The recipe is not stored.
+func ParseCooklang(text string) (*Recipe, error) {
+  recipe := &Recipe{
+    Ingredients: []Ingredient{},
+    Steps: []Step{},
+    Tags: []string{},
+    Images: []Image{},
+  }
+
+  text = strings.Replace(text, "\r\n", "\n", -1)
+  text = cooklangBlockComment.ReplaceAllString(text, "")
+  lines := strings.Split(text, "\n")
+
+  // Front matter
+  if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+    for idx := 1; idx < len(lines); idx++ {
+      if strings.TrimSpace(lines[idx]) == "---" {
+        for _, line := range lines[1:idx] {
+          recipe.setCooklangMetadata(line)
+        }
+        lines = lines[idx + 1:]
+        break
+      }
+    }
+  }
+
+  notes := []string{}
+  paragraph := []string{}
+  flush := func() {
+    if len(paragraph) > 0 {
+      recipe.addCooklangStep(strings.Join(paragraph, " "))
+      paragraph = nil
+    }
+  }
+  for _, line := range lines {
+    if idx := strings.Index(line, "--"); idx >= 0 {
+      line = line[:idx]
+    }
+    line = strings.TrimSpace(line)
+    switch {
+    case line == "":
+      flush()
+    case strings.HasPrefix(line, ">>"):
+      flush()
+      recipe.setCooklangMetadata(strings.TrimPrefix(line, ">>"))
+    case strings.HasPrefix(line, ">"):
+      flush()
+      notes = append(notes, strings.TrimSpace(strings.TrimPrefix(line, ">")))
+    case strings.HasPrefix(line, "="):
+      // Sections have no counterpart in the recipe
+      flush()
+    default:
+      paragraph = append(paragraph, line)
+    }
+  }
+  flush()
+
+  if len(notes) > 0 {
+    recipe.Description = strings.Join(notes, "\n")
+  }
+  return recipe, nil
+}
+
+func (recipe *Recipe)setCooklangMetadata(line string) {
+  parts := strings.SplitN(line, ":", 2)
+  if len(parts) != 2 {
+    return
+  }
+  key := strings.ToLower(strings.Join(strings.FieldsFunc(parts[0], func(r rune) bool {
+    return r == ' ' || r == '_' || r == '-'
+  }), " "))
+  value := strings.TrimSpace(parts[1])
+  switch key {
+  case "title":
+    recipe.Title = value
+  case "description":
+    recipe.Description = value
+  case "servings", "serves", "yield":
+    recipe.Servings = schemaYield(value)
+  case "tags", "keywords":
+    value = strings.Trim(value, "[]")
+    for _, tag := range strings.Split(value, ",") {
+      tag = NormalizeTag(strings.Trim(strings.TrimSpace(tag), `"'`))
+      if ValidateTag(tag) == nil {
+        recipe.Tags = append(recipe.Tags, tag)
+      }
+    }
+  case "prep time", "preptime":
+    recipe.PrepTime = parseCooklangDuration(value)
+  case "cook time", "cooktime":
+    recipe.CookTime = parseCooklangDuration(value)
+  case "total time", "time required", "time":
+    recipe.TotalTime = parseCooklangDuration(value)
+  }
+}
+
+// Durations like "1 hour 30 minutes", "90 min", "PT1H30M", plain numbers
+// are minutes
+func parseCooklangDuration(text string) *int64 {
+  if duration := ParseIsoDuration(text); duration != nil {
+    return duration
+  }
+  var seconds float64
+  found := false
+  for _, match := range cooklangDuration.FindAllStringSubmatch(text, -1) {
+    value, err := strconv.ParseFloat(strings.Replace(match[1], ",", ".", 1), 64)
+    if err != nil {
+      return nil
+    }
+    factor, ok := timeUnits[strings.ToLower(match[2])]
+    if match[2] == "" {
+      factor, ok = 60, true
+    }
+    if ! ok {
+      return nil
+    }
+    seconds += value * factor
+    found = true
+  }
+  if ! found {
+    return nil
+  }
+  result := int64(math.Round(seconds))
+  return &result
+}
+
+// Adds a step, new ingredients of the step are added to the recipe
+func (recipe *Recipe)addCooklangStep(line string) {
+  // Escaped markers are kept away from the tokenizer
+  line = strings.NewReplacer("\\\\", "\x00", "\\@", "\x01", "\\#", "\x02", "\\~", "\x03").Replace(line)
+
+  step := Step{Ingredients: []int64{}}
+  var duration float64
+  hasDuration := false
+  text := cooklangToken.ReplaceAllStringFunc(line, func(token string) string {
+    match := cooklangToken.FindStringSubmatch(token)
+    name := strings.TrimSpace(match[2] + match[5])
+    amount := strings.TrimSpace(match[3])
+    unit := ""
+    if parts := strings.SplitN(amount, "%", 2); len(parts) == 2 {
+      amount, unit = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+    }
+    amount = strings.TrimPrefix(amount, "=")
+
+    switch match[1] {
+    case "@":
+      name = strings.TrimPrefix(name, "&")
+      step.ingredientRefs = append(step.ingredientRefs, recipe.cooklangIngredient(name, amount, unit, match[4]))
+      return name
+    case "~":
+      value, err := strconv.ParseFloat(strings.Replace(amount, ",", ".", 1), 64)
+      factor, ok := timeUnits[strings.ToLower(unit)]
+      if err == nil && ok {
+        duration += value * factor
+        hasDuration = true
+      }
+      if name != "" && amount == "" {
+        return name
+      }
+      return strings.TrimSpace(amount + " " + unit)
+    }
+    return name
+  })
+
+  step.Text = strings.NewReplacer("\x00", "\\", "\x01", "@", "\x02", "#", "\x03", "~").Replace(text)
+  step.Text = strings.Join(strings.Fields(step.Text), " ")
+  if hasDuration {
+    seconds := int64(math.Round(duration))
+    step.Duration = &seconds
+  }
+  recipe.Steps = append(recipe.Steps, step)
+}
+
+// Returns the position of the ingredient in the recipe. A mention without
+// quantity of an ingredient already in the recipe references it.
+func (recipe *Recipe)cooklangIngredient(name, amount, unit, note string) int {
+  if amount == "" {
+    for idx, ingredient := range recipe.Ingredients {
+      if strings.EqualFold(ingredient.Name, name) {
+        return idx
+      }
+    }
+  }
+  quantity := strings.TrimSpace(amount + " " + unit)
+  if note = strings.TrimSpace(note); note != "" && quantity != "" {
+    quantity += ", " + note
+  }
+  ingredient := Ingredient{Name: name, Quantity: quantity}
+  ingredient.normalize()
+  if ingredient.Amount == nil && note != "" {
+    ingredient.Note = note
+  }
+  recipe.Ingredients = append(recipe.Ingredients, ingredient)
+  return len(recipe.Ingredients) - 1
+}
+
+// The recipe as Cooklang. Ingredients are marked where a step mentions
+// them, ingredients no step mentions are listed in a first step.
+func (recipe *Recipe)Cooklang() string {
+  var text strings.Builder
+  if recipe.Title != "" {
+    text.WriteString(">> title: " + recipe.Title + "\n")
+  }
+  if recipe.Servings > 0 {
+    text.WriteString(">> servings: " + strconv.Itoa(recipe.Servings) + "\n")
+  }
+  if len(recipe.Tags) > 0 {
+    text.WriteString(">> tags: " + strings.Join(recipe.Tags, ", ") + "\n")
+  }
+  times := []struct{
+    key string
+    duration *int64
+  }{
+    {"prep time", recipe.PrepTime},
+    {"cook time", recipe.CookTime},
+    {"total time", recipe.TotalTime},
+  }
+  for _, t := range times {
+    if t.duration != nil {
+      text.WriteString(">> " + t.key + ": " + formatCooklangDuration(*(t.duration)) + "\n")
+    }
+  }
+  if text.Len() > 0 {
+    text.WriteString("\n")
+  }
+
+  if recipe.Description != "" {
+    for _, line := range strings.Split(recipe.Description, "\n") {
+      text.WriteString(strings.TrimSpace("> " + line) + "\n")
+    }
+    text.WriteString("\n")
+  }
+
+  positions := map[int64]int{}
+  referenced := map[int]bool{}
+  for idx, ingredient := range recipe.Ingredients {
+    positions[ingredient.ID] = idx
+  }
+  for _, step := range recipe.Steps {
+    for _, id := range step.Ingredients {
+      if idx, ok := positions[id]; ok {
+        referenced[idx] = true
+      }
+    }
+  }
+
+  paragraphs := []string{}
+  unreferenced := []string{}
+  for idx, ingredient := range recipe.Ingredients {
+    if ! referenced[idx] {
+      unreferenced = append(unreferenced, ingredient.cooklang(false))
+    }
+  }
+  if len(unreferenced) > 0 {
+    paragraphs = append(paragraphs, strings.Join(unreferenced, ", "))
+  }
+
+  written := map[int]bool{}
+  for _, step := range recipe.Steps {
+    paragraphs = append(paragraphs, recipe.cooklangStep(step, positions, written))
+  }
+  text.WriteString(strings.Join(paragraphs, "\n\n"))
+  if len(paragraphs) > 0 {
+    text.WriteString("\n")
+  }
+  return text.String()
+}
+
+func (recipe *Recipe)cooklangStep(step Step, positions map[int64]int, written map[int]bool) string {
+  line := cooklangEscaper.Replace(step.Text)
+
+  // Markup goes in as placeholders so later names don't match inside it
+  markup := []string{}
+  placeholder := func(text string) string {
+    markup = append(markup, text)
+    return "\x00" + strconv.Itoa(len(markup) - 1) + "\x00"
+  }
+
+  if step.Duration != nil {
+    matches := cooklangTimerText.FindAllStringSubmatchIndex(line, -1)
+    var sum float64
+    for _, match := range matches {
+      value, _ := strconv.ParseFloat(strings.Replace(line[match[2]:match[3]], ",", ".", 1), 64)
+      sum += value * timeUnits[strings.ToLower(line[match[4]:match[5]])]
+    }
+    if len(matches) > 0 && int64(math.Round(sum)) == *(step.Duration) {
+      line = cooklangTimerText.ReplaceAllStringFunc(line, func(timer string) string {
+        match := cooklangTimerText.FindStringSubmatch(timer)
+        return placeholder("~{" + match[1] + "%" + match[2] + "}")
+      })
+    } else {
+      line += " " + placeholder("~{" + formatCooklangTimer(*(step.Duration)) + "}")
+    }
+  }
+
+  missing := []string{}
+  for _, id := range step.Ingredients {
+    idx, ok := positions[id]
+    if ! ok {
+      continue
+    }
+    ingredient := recipe.Ingredients[idx]
+    token := ingredient.cooklang(written[idx])
+    written[idx] = true
+    mention := regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}_])(` + regexp.QuoteMeta(cooklangEscaper.Replace(ingredient.Name)) + `)([^\p{L}\p{N}_]|$)`)
+    found := mention.FindStringSubmatchIndex(line)
+    if found == nil {
+      missing = append(missing, placeholder(token))
+      continue
+    }
+    line = line[:found[4]] + placeholder(token) + line[found[5]:]
+  }
+  if len(missing) > 0 {
+    line += " " + strings.Join(missing, ", ")
+  }
+
+  for idx, text := range markup {
+    line = strings.Replace(line, "\x00" + strconv.Itoa(idx) + "\x00", text, 1)
+  }
+  return strings.TrimSpace(line)
+}
+
+// The ingredient as Cooklang markup, references only name the ingredient
+func (ingredient Ingredient) cooklang(reference bool) string {
+  name := strings.Map(func(r rune) rune {
+    if strings.ContainsRune("@#~{}", r) {
+      return -1
+    }
+    return r
+  }, ingredient.Name)
+  amount := ""
+  if ! reference {
+    if ingredient.Amount != nil {
+      amount = FormatAmount(*(ingredient.Amount))
+      if ingredient.Unit != "" {
+        amount += "%" + ingredient.Unit
+      }
+    } else {
+      amount = strings.NewReplacer("{", "", "}", "", "%", " ").Replace(ingredient.Quantity)
+    }
+  }
+
+  token := "@" + name
+  if amount != "" || ! cooklangWord.MatchString(name) {
+    token += "{" + amount + "}"
+  }
+  if ! reference && ingredient.Amount != nil && ingredient.Note != "" {
+    token += "(" + strings.NewReplacer("(", "", ")", "").Replace(ingredient.Note) + ")"
+  }
+  return token
+}
+
+func formatCooklangTimer(seconds int64) string {
+  switch {
+  case seconds > 0 && seconds % 3600 == 0:
+    return strconv.FormatInt(seconds / 3600, 10) + "%hours"
+  case seconds > 0 && seconds % 60 == 0:
+    return strconv.FormatInt(seconds / 60, 10) + "%minutes"
+  }
+  return strconv.FormatInt(seconds, 10) + "%seconds"
+}
+
+func formatCooklangDuration(seconds int64) string {
+  return strings.Replace(formatCooklangTimer(seconds), "%", " ", 1)
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// Gives ingredients the ids storing the recipe would, steps reference them
+// by id afterwards like a recipe loaded from the database
+func storeIds(recipe *Recipe) {
+  for idx := range recipe.Ingredients {
+    recipe.Ingredients[idx].ID = int64(idx + 1)
+  }
+  for idx := range recipe.Steps {
+    step := &(recipe.Steps[idx])
+    step.Ingredients = []int64{}
+    for _, position := range step.ingredientRefs {
+      step.Ingredients = append(step.Ingredients, int64(position + 1))
+    }
+    step.ingredientRefs = nil
+  }
+}
+
+func parseCooklangFile(t *testing.T, path string) (*Recipe, string) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  recipe, err := ParseCooklang(string(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  storeIds(recipe)
+  return recipe, string(data)
+}
+
+func TestCooklangRoundTrip(t *testing.T) {
+  files, err := filepath.Glob(filepath.Join("testdata", "*.cook"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(files) == 0 {
+    t.Fatal("no samples in testdata")
+  }
+
+  for _, file := range files {
+    t.Run(filepath.Base(file), func(t *testing.T) {
+      first, _ := parseCooklangFile(t, file)
+      if first.Title == "" || len(first.Ingredients) == 0 || len(first.Steps) == 0 {
+        t.Fatalf("sample not understood: %+v", first)
+      }
+
+      exported := first.Cooklang()
+      second, err := ParseCooklang(exported)
+      if err != nil {
+        t.Fatal(err)
+      }
+      storeIds(second)
+
+      if ! reflect.DeepEqual(first, second) {
+        t.Errorf("recipe changed by the round trip\nfirst:  %+v\nsecond: %+v\nexported:\n%s", first, second, exported)
+      }
+      if again := second.Cooklang(); again != exported {
+        t.Errorf("export not stable\nfirst:\n%s\nsecond:\n%s", exported, again)
+      }
+    })
+  }
+}
+
+func TestCooklangParse(t *testing.T) {
+  recipe, _ := parseCooklangFile(t, filepath.Join("testdata", "pancakes.cook"))
+
+  expected := []struct{
+    name string
+    amount float64
+    unit string
+    note string
+  }{
+    {"plain flour", 125, "g", ""},
+    {"milk", 250, "ml", ""},
+    {"egg", 2, "", "beaten"},
+    {"butter", 1, "tbsp", ""},
+  }
+  if len(recipe.Ingredients) != len(expected) {
+    t.Fatalf("expected %d ingredients, got %+v", len(expected), recipe.Ingredients)
+  }
+  for idx, want := range expected {
+    got := recipe.Ingredients[idx]
+    if got.Name != want.name || got.Amount == nil || *(got.Amount) != want.amount || got.Unit != want.unit || got.Note != want.note {
+      t.Errorf("ingredient %d: expected %+v, got %+v", idx, want, got)
+    }
+  }
+
+  if recipe.Servings != 4 || recipe.PrepTime == nil || *(recipe.PrepTime) != 600 || recipe.CookTime == nil || *(recipe.CookTime) != 1200 {
+    t.Errorf("metadata not parsed: %+v", recipe)
+  }
+  if recipe.Description != "Thin pancakes for a lazy Sunday." {
+    t.Errorf("unexpected description %q", recipe.Description)
+  }
+
+  if len(recipe.Steps) != 3 {
+    t.Fatalf("expected 3 steps, got %+v", recipe.Steps)
+  }
+  if ! reflect.DeepEqual(recipe.Steps[0].Ingredients, []int64{1, 2, 3}) {
+    t.Errorf("first step should use flour, milk and egg, got %v", recipe.Steps[0].Ingredients)
+  }
+  for idx, seconds := range []int64{0, 900, 120} {
+    duration := recipe.Steps[idx].Duration
+    if (seconds == 0 && duration != nil) || (seconds != 0 && (duration == nil || *duration != seconds)) {
+      t.Errorf("step %d: expected duration %d, got %v", idx, seconds, duration)
+    }
+  }
+
+  // Comments are dropped
+  for _, step := range recipe.Steps {
+    if strings.Contains(step.Text, "spelt") || strings.Contains(step.Text, "longer") {
+      t.Errorf("comment left in step %q", step.Text)
+    }
+  }
+}
+
+// Cookware has no counterpart in the recipe, only its name stays in the
+// step text and an export doesn't mark it again
+func TestCooklangDropsCookware(t *testing.T) {
+  recipe, _ := parseCooklangFile(t, filepath.Join("testdata", "pancakes.cook"))
+
+  if recipe.Steps[0].Text != "Whisk plain flour, milk and egg in a large bowl." {
+    t.Errorf("unexpected step text %q", recipe.Steps[0].Text)
+  }
+  if ! strings.Contains(recipe.Steps[2].Text, "in a frying pan and") {
+    t.Errorf("cookware name missing in %q", recipe.Steps[2].Text)
+  }
+
+  exported := recipe.Cooklang()
+  if strings.Contains(exported, "#") {
+    t.Errorf("export contains cookware markup:\n%s", exported)
+  }
+  if ! strings.Contains(exported, "in a large bowl.") {
+    t.Errorf("cookware name missing in export:\n%s", exported)
+  }
+}
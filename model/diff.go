@@ -0,0 +1,96 @@
+package model
+
+import (
+  "reflect"
+)
+
+type FieldChange struct {
+  Field string `json:"field"`
+  From interface{} `json:"from"`
+  To interface{} `json:"to"`
+}
+
+// A step that differs at a position, From or To is nil for added and
+// removed steps
+type StepChange struct {
+  Position int `json:"position"`
+  From *Step `json:"from"`
+  To *Step `json:"to"`
+}
+
+// Changes between two recipe states. Ingredients and tags are compared as
+// sets, steps by position.
+type RecipeDiff struct {
+  From int `json:"from"`
+  To int `json:"to"`
+  Fields []FieldChange `json:"fields"`
+  IngredientsAdded []string `json:"ingredientsAdded"`
+  IngredientsRemoved []string `json:"ingredientsRemoved"`
+  Steps []StepChange `json:"steps"`
+  TagsAdded []string `json:"tagsAdded"`
+  TagsRemoved []string `json:"tagsRemoved"`
+}
+
+func DiffRecipes(from, to *Recipe) *RecipeDiff {
+  diff := &RecipeDiff{Fields: []FieldChange{}, Steps: []StepChange{}}
+
+  fields := []FieldChange{
+    {"title", from.Title, to.Title},
+    {"description", from.Description, to.Description},
+    {"servings", from.Servings, to.Servings},
+    {"prepTime", from.PrepTime, to.PrepTime},
+    {"cookTime", from.CookTime, to.CookTime},
+    {"totalTime", from.TotalTime, to.TotalTime},
+  }
+  for _, field := range fields {
+    if ! reflect.DeepEqual(field.From, field.To) {
+      diff.Fields = append(diff.Fields, field)
+    }
+  }
+
+  fromIngredients := make([]string, len(from.Ingredients))
+  for idx, ingredient := range from.Ingredients {
+    fromIngredients[idx] = ingredient.Line()
+  }
+  toIngredients := make([]string, len(to.Ingredients))
+  for idx, ingredient := range to.Ingredients {
+    toIngredients[idx] = ingredient.Line()
+  }
+  diff.IngredientsAdded = missingFrom(toIngredients, fromIngredients)
+  diff.IngredientsRemoved = missingFrom(fromIngredients, toIngredients)
+  diff.TagsAdded = missingFrom(to.Tags, from.Tags)
+  diff.TagsRemoved = missingFrom(from.Tags, to.Tags)
+
+  for idx := 0; idx < len(from.Steps) || idx < len(to.Steps); idx++ {
+    change := StepChange{Position: idx + 1}
+    if idx < len(from.Steps) {
+      change.From = &(from.Steps[idx])
+    }
+    if idx < len(to.Steps) {
+      change.To = &(to.Steps[idx])
+    }
+    if change.From != nil && change.To != nil && change.From.Text == change.To.Text &&
+      reflect.DeepEqual(change.From.Duration, change.To.Duration) {
+      continue
+    }
+    diff.Steps = append(diff.Steps, change)
+  }
+  return diff
+}
+
+// Entries of list not in other, duplicates count
+func missingFrom(list, other []string) []string {
+  counts := map[string]int{}
+  for _, entry := range other {
+    counts[entry]++
+  }
+  result := []string{}
+  for _, entry := range list {
+    if counts[entry] > 0 {
+      counts[entry]--
+      continue
+    }
+    result = append(result, entry)
+  }
+  return result
+}
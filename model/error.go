@@ -0,0 +1,15 @@
+package model
+
+import "errors"
+
+// The stored version differs from the one a change is based on, someone
+// else saved in between
+var ErrVersionConflict = errors.New("changed by someone else")
+
+// Returned for invalid input found while saving, the transaction should be
+// rolled back and the message shown to the client
+type ValidationError string
+
+func (err ValidationError) Error() string {
+  return string(err)
+}
@@ -0,0 +1,128 @@
+package model
+
+import (
+  "database/sql"
+  "strconv"
+  "time"
+)
+
+const ImageOriginal = "original"
+
+// Longest side of the generated image sizes
+var ImageSizes = map[string]int{
+  "medium": 1024,
+  "thumbnail": 256,
+}
+
+// URL points to the original upload, Sizes to the scaled down JPEGs
+type Image struct {
+  ID int64 `json:"id"`
+  Recipe int64 `json:"recipe"`
+  ContentType string `json:"contentType"`
+  Width int `json:"width"`
+  Height int `json:"height"`
+  CreatedBy int64 `json:"createdBy"`
+  CreatedAt time.Time `json:"createdAt"`
+  URL string `json:"url"`
+  Sizes map[string]string `json:"sizes"`
+}
+
+const imageColumns = "`id`, `recipe`, `content_type`, `width`, `height`, `created_by`, `created_at`"
+
+func scanImage(row scanner, image *Image) error {
+  err := row.Scan(&(image.ID), &(image.Recipe), &(image.ContentType),
+    &(image.Width), &(image.Height), &(image.CreatedBy), &(image.CreatedAt))
+  if err != nil {
+    return err
+  }
+  image.setURLs()
+  return nil
+}
+
+func (image *Image)setURLs() {
+  image.URL = "/recipes/" + strconv.FormatInt(image.Recipe, 10) + "/images/" + strconv.FormatInt(image.ID, 10)
+  image.Sizes = map[string]string{}
+  for size := range ImageSizes {
+    image.Sizes[size] = image.URL + "?size=" + size
+  }
+}
+
+// Key of the file in the storage, size is ImageOriginal or one of ImageSizes
+func (image *Image)StorageKey(size string) string {
+  return "recipe/" + strconv.FormatInt(image.Recipe, 10) + "/image/" +
+    strconv.FormatInt(image.ID, 10) + "/" + size
+}
+
+// Images of recipes in the trash are not found
+func GetImage(tx *sql.Tx, recipeId, id int64) (*Image, error) {
+  image := &Image{}
+  row := tx.QueryRow("SELECT " + imageColumns + " FROM `image` WHERE `id` = ? AND `recipe` = ? " +
+    "AND EXISTS (SELECT 1 FROM `recipe` WHERE `recipe`.`id` = `image`.`recipe` AND " + recipeLive + ")", id, recipeId)
+  err := scanImage(row, image)
+  if err != nil {
+    return nil, err
+  }
+  return image, nil
+}
+
+// Loads the images of many recipes, recipes without images get an empty list
+func GetImagesForRecipes(tx *sql.Tx, recipeIds []int64) (map[int64][]Image, error) {
+  result := make(map[int64][]Image, len(recipeIds))
+  for _, id := range recipeIds {
+    result[id] = []Image{}
+  }
+
+  err := forIdBatches(recipeIds, func(in string, args []interface{}) error {
+    rows, err := tx.Query(
+      "SELECT " + imageColumns + " FROM `image` WHERE `recipe` IN " + in + " ORDER BY `id`", args...)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      image := Image{}
+      err = scanImage(rows, &image)
+      if err != nil {
+        return err
+      }
+      result[image.Recipe] = append(result[image.Recipe], image)
+    }
+    return rows.Err()
+  })
+  if err != nil {
+    return nil, err
+  }
+  return result, nil
+}
+
+func (image *Image)Create(tx *sql.Tx) error {
+  image.CreatedAt = time.Now().UTC()
+  result, err := tx.Exec(
+    "INSERT INTO `image` (`recipe`, `content_type`, `width`, `height`, `created_by`, `created_at`) VALUES (?,?,?,?,?,?)",
+    image.Recipe, image.ContentType, image.Width, image.Height, image.CreatedBy, image.CreatedAt)
+  if err != nil {
+    return err
+  }
+  image.ID, err = result.LastInsertId()
+  if err != nil {
+    return err
+  }
+  image.setURLs()
+  return image.touchRecipe(tx)
+}
+
+// Only removes the database row, the files have to be removed from the
+// storage after the commit
+func (image *Image)Delete(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `image` WHERE `id` = ?", image.ID)
+  if err != nil {
+    return err
+  }
+  return image.touchRecipe(tx)
+}
+
+// The image list is part of the recipe, so its ETag has to change
+func (image *Image)touchRecipe(tx *sql.Tx) error {
+  _, err := tx.Exec("UPDATE `recipe` SET `version` = `version` + 1 WHERE `id` = ?", image.Recipe)
+  return err
+}
@@ -2,18 +2,60 @@ package model
 
 import (
   "database/sql"
+  "strings"
 )
 
+// Quantity is the text as written, Amount, Unit and Note are parsed from
+// it. Amount is nil if the text could not be understood.
 type Ingredient struct {
   ID int64 `json:"id"`
   Name string `json:"name"`
   Quantity string `json:"quantity"`
+  Amount *float64 `json:"amount"`
+  Unit string `json:"unit"`
+  Note string `json:"note"`
+}
+
+const ingredientColumns = "`id`, `name`, `quantity`, `amount`, `unit`, `note`"
+
+func scanIngredient(row scanner, ingredient *Ingredient, extra ...interface{}) error {
+  dest := []interface{}{&(ingredient.ID), &(ingredient.Name), &(ingredient.Quantity),
+    &(ingredient.Amount), &(ingredient.Unit), &(ingredient.Note)}
+  return row.Scan(append(dest, extra...)...)
+}
+
+func (ingredient *Ingredient)Validate() error {
+  if ingredient.Unit != "" {
+    if _, ok := LookupUnit(ingredient.Unit); ! ok {
+      return ValidationError("unknown unit " + ingredient.Unit)
+    }
+  }
+  return nil
+}
+
+// The quantity text wins if it can be parsed, otherwise structured values
+// sent by the client are kept and the text is made from them if missing
+func (ingredient *Ingredient)normalize() {
+  if ingredient.Quantity != "" {
+    if quantity, ok := ParseQuantity(ingredient.Quantity); ok {
+      ingredient.Amount = &(quantity.Amount)
+      ingredient.Unit = quantity.Unit
+      ingredient.Note = quantity.Note
+      return
+    }
+  }
+  if unit, ok := LookupUnit(ingredient.Unit); ok {
+    ingredient.Unit = unit.Name
+  }
+  if ingredient.Quantity == "" && ingredient.Amount != nil {
+    ingredient.Quantity = Quantity{*(ingredient.Amount), ingredient.Unit, ingredient.Note}.String()
+  }
 }
 
 func GetIngrediants(tx *sql.Tx, recipeId int64) (* []Ingredient, error) {
   list := []Ingredient{}
 
-  rows, err := tx.Query("SELECT `id`, `name`, `quantity` FROM `ingredient` WHERE `recipe` = ?", recipeId)
+  rows, err := tx.Query("SELECT " + ingredientColumns + " FROM `ingredient` WHERE `recipe` = ?", recipeId)
   if err != nil {
     return nil, err
   }
@@ -21,7 +63,7 @@ func GetIngrediants(tx *sql.Tx, recipeId int64) (* []Ingredient, error) {
   defer rows.Close()
   for rows.Next() {
     ingredient := Ingredient{}
-    err = rows.Scan(&(ingredient.ID), &(ingredient.Name), &(ingredient.Quantity))
+    err = scanIngredient(rows, &ingredient)
     if err != nil {
       return nil, err
     }
@@ -35,15 +77,52 @@ func GetIngrediants(tx *sql.Tx, recipeId int64) (* []Ingredient, error) {
   return &list, nil
 }
 
+// Loads the ingredients of many recipes with one query per batch of ids,
+// recipes without ingredients get an empty list
+func GetIngrediantsForRecipes(tx *sql.Tx, recipeIds []int64) (map[int64][]Ingredient, error) {
+  result := make(map[int64][]Ingredient, len(recipeIds))
+  for _, id := range recipeIds {
+    result[id] = []Ingredient{}
+  }
+
+  err := forIdBatches(recipeIds, func(in string, args []interface{}) error {
+    rows, err := tx.Query(
+      "SELECT " + ingredientColumns + ", `recipe` FROM `ingredient` WHERE `recipe` IN " + in +
+      " ORDER BY `id`", args...)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var recipeId int64
+      ingredient := Ingredient{}
+      err = scanIngredient(rows, &ingredient, &recipeId)
+      if err != nil {
+        return err
+      }
+      result[recipeId] = append(result[recipeId], ingredient)
+    }
+    return rows.Err()
+  })
+  if err != nil {
+    return nil, err
+  }
+  return result, nil
+}
+
 func (ingredient *Ingredient)Delete(tx *sql.Tx) error {
-  _, err := tx.Exec("DELETE FROM `ingredient` WHERE `id` = ?", ingredient.ID)
+  _, err := tx.Exec("DELETE FROM `step_ingredient` WHERE `ingredient` = ?", ingredient.ID)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec("DELETE FROM `ingredient` WHERE `id` = ?", ingredient.ID)
   return err
 }
 
 func (ingredient *Ingredient)Create(tx *sql.Tx, recipe *Recipe) error {
   result, err := tx.Exec(
-    "INSERT INTO `ingredient` (`name`, `quantity`, `recipe`) VALUES (?,?,?)",
-    ingredient.Name, ingredient.Quantity, recipe.ID)
+    "INSERT INTO `ingredient` (`name`, `quantity`, `amount`, `unit`, `note`, `recipe`) VALUES (?,?,?,?,?,?)",
+    ingredient.Name, ingredient.Quantity, ingredient.Amount, ingredient.Unit, ingredient.Note, recipe.ID)
   if err != nil {
     return err
   }
@@ -65,7 +144,44 @@ func HasIngrediantForRecipe(tx *sql.Tx, id, recipe int64) (bool, error) {
 
 func (ingredient *Ingredient)Update(tx *sql.Tx) error {
   _, err := tx.Exec(
-    "UPDATE `ingredient` SET `name` = ?, `quantity` = ? WHERE `id` = ?",
-    ingredient.Name, ingredient.Quantity, ingredient.ID)
+    "UPDATE `ingredient` SET `name` = ?, `quantity` = ?, `amount` = ?, `unit` = ?, `note` = ? WHERE `id` = ?",
+    ingredient.Name, ingredient.Quantity, ingredient.Amount, ingredient.Unit, ingredient.Note, ingredient.ID)
   return err
 }
+
+// Splits a free text line like "2 cups flour, sifted" into quantity and
+// name. The longest leading part that parses as quantity is taken, lines
+// without quantity become the name only.
+func ParseIngredientLine(line string) Ingredient {
+  main, note := splitNote(strings.TrimSpace(line))
+  fields := strings.Fields(main)
+  for n := len(fields) - 1; n > 0; n-- {
+    text := strings.Join(fields[:n], " ")
+    if _, ok := ParseQuantity(text); ! ok {
+      continue
+    }
+    name := strings.Join(fields[n:], " ")
+    if strings.HasPrefix(strings.ToLower(name), "of ") && n + 1 < len(fields) {
+      name = strings.Join(fields[n + 1:], " ")
+    }
+    if note != "" {
+      text += ", " + note
+    }
+    ingredient := Ingredient{Name: name, Quantity: text}
+    ingredient.normalize()
+    return ingredient
+  }
+  return Ingredient{Name: strings.Join(strings.Fields(line), " ")}
+}
+
+// The ingredient as one line like "2 cup flour, sifted"
+func (ingredient Ingredient) Line() string {
+  if ingredient.Amount == nil {
+    return strings.TrimSpace(ingredient.Quantity + " " + ingredient.Name)
+  }
+  line := Quantity{*(ingredient.Amount), ingredient.Unit, ""}.String() + " " + ingredient.Name
+  if ingredient.Note != "" {
+    line += ", " + ingredient.Note
+  }
+  return line
+}
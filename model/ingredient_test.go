@@ -0,0 +1,146 @@
+package model_test
+
+import (
+  "database/sql"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "testing"
+  "time"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
+)
+
+const (
+  seedRecipes = 1000
+  seedIngredients = 8
+)
+
+// Creates an empty food.db in a temp dir and makes it the working dir
+// for the rest of the test
+func tempDatabase(tb testing.TB) {
+  tb.Helper()
+  dir := tb.TempDir()
+  cwd, err := os.Getwd()
+  if err != nil {
+    tb.Fatal(err)
+  }
+  err = os.Chdir(dir)
+  if err != nil {
+    tb.Fatal(err)
+  }
+  tb.Cleanup(func() {
+    os.Chdir(cwd)
+  })
+
+  log.SetOutput(ioutil.Discard)
+  defer log.SetOutput(os.Stderr)
+  err = library.InitDb()
+  if err != nil && err != library.ErrNoFts5 {
+    tb.Fatal(err)
+  }
+}
+
+// Creates food.db in a temp dir with seedRecipes recipes of
+// seedIngredients ingredients each and returns the recipe ids
+func seedDatabase(b *testing.B) []int64 {
+  b.Helper()
+  tempDatabase(b)
+
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    b.Fatal(err)
+  }
+  defer db.Close()
+
+  ids := make([]int64, 0, seedRecipes)
+  now := time.Now().UTC()
+  for r := 0; r < seedRecipes; r++ {
+    result, err := tx.Exec("INSERT INTO `recipe` (`title`, `description`, `created_by`, `updated_by`, `created_at`, `updated_at`) VALUES (?, ?, 1, 1, ?, ?)",
+      fmt.Sprintf("Recipe %d", r), "Seeded", now, now)
+    if err != nil {
+      b.Fatal(err)
+    }
+    id, _ := result.LastInsertId()
+    ids = append(ids, id)
+    for i := 0; i < seedIngredients; i++ {
+      _, err = tx.Exec("INSERT INTO `ingredient` (`name`, `quantity`, `amount`, `unit`, `recipe`) VALUES (?, '100 g', 100, 'g', ?)",
+        fmt.Sprintf("Ingredient %d", i), id)
+      if err != nil {
+        b.Fatal(err)
+      }
+    }
+  }
+  err = tx.Commit()
+  if err != nil {
+    b.Fatal(err)
+  }
+  return ids
+}
+
+func withTransaction(tb testing.TB, fn func(tx *sql.Tx) error) {
+  tb.Helper()
+  db, tx, err := library.CreateTransaction()
+  if err != nil {
+    tb.Fatal(err)
+  }
+  defer db.Close()
+  defer tx.Commit()
+  err = fn(tx)
+  if err != nil {
+    tb.Fatal(err)
+  }
+}
+
+// The loading before batching, one query per recipe
+func BenchmarkIngredientsPerRecipe(b *testing.B) {
+  ids := seedDatabase(b)
+  withTransaction(b, func(tx *sql.Tx) error {
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+      for _, id := range ids {
+        _, err := model.GetIngrediants(tx, id)
+        if err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+}
+
+func BenchmarkIngredientsForRecipes(b *testing.B) {
+  ids := seedDatabase(b)
+  withTransaction(b, func(tx *sql.Tx) error {
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+      result, err := model.GetIngrediantsForRecipes(tx, ids)
+      if err != nil {
+        return err
+      }
+      if len(result[ids[0]]) != seedIngredients {
+        return fmt.Errorf("expected %d ingredients, got %d", seedIngredients, len(result[ids[0]]))
+      }
+    }
+    return nil
+  })
+}
+
+// A full page with all relations loaded
+func BenchmarkGetListPage(b *testing.B) {
+  seedDatabase(b)
+  withTransaction(b, func(tx *sql.Tx) error {
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+      page, err := model.GetListPage(tx, 1, seedRecipes, &model.RecipeQuery{})
+      if err != nil {
+        return err
+      }
+      if len(page.List) != seedRecipes {
+        return fmt.Errorf("expected %d recipes, got %d", seedRecipes, len(page.List))
+      }
+    }
+    return nil
+  })
+}
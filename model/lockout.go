@@ -0,0 +1,180 @@
+package model
+
+import (
+  "database/sql"
+  "time"
+)
+
+const (
+  LockoutAccount = "account"
+  LockoutAddress = "address"
+)
+
+// Limits for failed logins, each failure doubles the wait before the next
+// attempt starts at Backoff up to MaxBackoff. After MaxFailures the key is
+// locked for Lockout. Failures are forgotten after Window without one.
+type LoginPolicy struct {
+  MaxFailures int
+  MaxAddressFailures int
+  Backoff time.Duration
+  MaxBackoff time.Duration
+  Lockout time.Duration
+  Window time.Duration
+}
+
+var DefaultLoginPolicy = LoginPolicy{
+  MaxFailures: 5,
+  MaxAddressFailures: 20,
+  Backoff: time.Second,
+  MaxBackoff: time.Minute,
+  Lockout: 15 * time.Minute,
+  Window: time.Hour,
+}
+
+type Lockout struct {
+  ID int64 `json:"id"`
+  Kind string `json:"kind"`
+  Key string `json:"key"`
+  Failures int `json:"failures"`
+  LastFailure time.Time `json:"lastFailure"`
+  LockedUntil time.Time `json:"lockedUntil"`
+}
+
+const lockoutColumns = "`id`, `kind`, `key`, `failures`, `last_failure`, `locked_until`"
+
+func scanLockout(row scanner, lockout *Lockout) error {
+  return row.Scan(&(lockout.ID), &(lockout.Kind), &(lockout.Key), &(lockout.Failures),
+    &(lockout.LastFailure), &(lockout.LockedUntil))
+}
+
+// How long the key has to wait before the next attempt, 0 if it may try
+func LoginWait(tx *sql.Tx, kind, key string) (time.Duration, error) {
+  var lockedUntil time.Time
+  err := tx.QueryRow("SELECT `locked_until` FROM `login_failure` WHERE `kind` = ? AND `key` = ?", kind, key).Scan(&lockedUntil)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  } else if err != nil {
+    return 0, err
+  }
+  wait := lockedUntil.Sub(time.Now())
+  if wait < 0 {
+    return 0, nil
+  }
+  return wait, nil
+}
+
+// Counts a failed login and sets the wait for the next one
+func (policy LoginPolicy) RecordFailure(tx *sql.Tx, kind, key string) error {
+  now := time.Now().UTC()
+  lockout := Lockout{Kind: kind, Key: key}
+  row := tx.QueryRow("SELECT " + lockoutColumns + " FROM `login_failure` WHERE `kind` = ? AND `key` = ?", kind, key)
+  err := scanLockout(row, &lockout)
+  if err != nil && err != sql.ErrNoRows {
+    return err
+  }
+  if err == sql.ErrNoRows || now.Sub(lockout.LastFailure) > policy.Window {
+    lockout.Failures = 0
+  }
+  lockout.Failures++
+  lockout.LastFailure = now
+
+  maxFailures := policy.MaxFailures
+  if kind == LockoutAddress {
+    maxFailures = policy.MaxAddressFailures
+  }
+  if lockout.Failures >= maxFailures {
+    lockout.LockedUntil = now.Add(policy.Lockout)
+  } else {
+    backoff := policy.Backoff
+    for idx := 1; idx < lockout.Failures && backoff < policy.MaxBackoff; idx++ {
+      backoff *= 2
+    }
+    if backoff > policy.MaxBackoff {
+      backoff = policy.MaxBackoff
+    }
+    lockout.LockedUntil = now.Add(backoff)
+  }
+
+  _, err = tx.Exec("INSERT INTO `login_failure` (`kind`, `key`, `failures`, `last_failure`, `locked_until`) VALUES (?, ?, ?, ?, ?) " +
+    "ON CONFLICT(`kind`, `key`) DO UPDATE SET `failures` = excluded.`failures`, `last_failure` = excluded.`last_failure`, `locked_until` = excluded.`locked_until`",
+    lockout.Kind, lockout.Key, lockout.Failures, lockout.LastFailure, lockout.LockedUntil)
+  return err
+}
+
+// The failures of a key, nil if there are none
+func GetLockout(tx *sql.Tx, kind, key string) (*Lockout, error) {
+  lockout := Lockout{}
+  row := tx.QueryRow("SELECT " + lockoutColumns + " FROM `login_failure` WHERE `kind` = ? AND `key` = ?", kind, key)
+  err := scanLockout(row, &lockout)
+  if err == sql.ErrNoRows {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  return &lockout, nil
+}
+
+// Takes back a failure recorded before an attempt that then succeeded,
+// previous is the state before it. Failures recorded in between are kept.
+func (policy LoginPolicy) ReleaseFailure(tx *sql.Tx, kind, key string, previous *Lockout) error {
+  current, err := GetLockout(tx, kind, key)
+  if err != nil || current == nil {
+    return err
+  }
+  if previous != nil && current.Failures == previous.Failures + 1 {
+    _, err = tx.Exec("UPDATE `login_failure` SET `failures` = ?, `last_failure` = ?, `locked_until` = ? WHERE `id` = ?",
+      previous.Failures, previous.LastFailure, previous.LockedUntil, current.ID)
+  } else if current.Failures <= 1 {
+    _, err = tx.Exec("DELETE FROM `login_failure` WHERE `id` = ?", current.ID)
+  } else {
+    _, err = tx.Exec("UPDATE `login_failure` SET `failures` = `failures` - 1 WHERE `id` = ?", current.ID)
+  }
+  return err
+}
+
+// Forgets the failures of a key after a successful login
+func ClearLoginFailures(tx *sql.Tx, kind, key string) error {
+  _, err := tx.Exec("DELETE FROM `login_failure` WHERE `kind` = ? AND `key` = ?", kind, key)
+  return err
+}
+
+// Keys with failures inside the window, locked ones first
+func (policy LoginPolicy) GetLockouts(tx *sql.Tx) ([]Lockout, error) {
+  list := []Lockout{}
+  rows, err := tx.Query("SELECT " + lockoutColumns + " FROM `login_failure` WHERE `last_failure` >= ? OR `locked_until` >= ? " +
+    "ORDER BY `locked_until` DESC", time.Now().UTC().Add(-policy.Window), time.Now().UTC())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    lockout := Lockout{}
+    err = scanLockout(rows, &lockout)
+    if err != nil {
+      return nil, err
+    }
+    list = append(list, lockout)
+  }
+  err = rows.Err()
+  if err != nil {
+    return nil, err
+  }
+  return list, nil
+}
+
+func DeleteLockout(tx *sql.Tx, id int64) (bool, error) {
+  result, err := tx.Exec("DELETE FROM `login_failure` WHERE `id` = ?", id)
+  if err != nil {
+    return false, err
+  }
+  changed, err := result.RowsAffected()
+  return changed > 0, err
+}
+
+// Removes failures that are outside the window and no longer locked
+func (policy LoginPolicy) DeleteStaleLockouts(tx *sql.Tx) error {
+  now := time.Now().UTC()
+  _, err := tx.Exec("DELETE FROM `login_failure` WHERE `last_failure` < ? AND `locked_until` < ?",
+    now.Add(-policy.Window), now)
+  return err
+}
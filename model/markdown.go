@@ -0,0 +1,92 @@
+package model
+
+import (
+  "strconv"
+  "strings"
+)
+
+var markdownEscaper = strings.NewReplacer(
+  "\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "[", "\\[", "]", "\\]", "#", "\\#", "<", "&lt;")
+
+func escapeMarkdown(text string) string {
+  return markdownEscaper.Replace(text)
+}
+
+// Formats seconds for people like "1 h 5 min"
+func FormatDuration(seconds int64) string {
+  parts := []string{}
+  if hours := seconds / 3600; hours > 0 {
+    parts = append(parts, strconv.FormatInt(hours, 10) + " h")
+  }
+  if minutes := seconds % 3600 / 60; minutes > 0 {
+    parts = append(parts, strconv.FormatInt(minutes, 10) + " min")
+  }
+  if rest := seconds % 60; rest > 0 || len(parts) == 0 {
+    parts = append(parts, strconv.FormatInt(rest, 10) + " s")
+  }
+  return strings.Join(parts, " ")
+}
+
+// The recipe as printable Markdown card
+func (recipe *Recipe)Markdown() string {
+  var text strings.Builder
+  text.WriteString("# " + escapeMarkdown(recipe.Title) + "\n\n")
+  if recipe.Description != "" {
+    text.WriteString(escapeMarkdown(recipe.Description) + "\n\n")
+  }
+
+  facts := []string{}
+  if recipe.Servings > 0 {
+    facts = append(facts, "**Servings:** " + strconv.Itoa(recipe.Servings))
+  }
+  if recipe.PrepTime != nil {
+    facts = append(facts, "**Prep:** " + FormatDuration(*(recipe.PrepTime)))
+  }
+  if recipe.CookTime != nil {
+    facts = append(facts, "**Cook:** " + FormatDuration(*(recipe.CookTime)))
+  }
+  if recipe.TotalTime != nil {
+    facts = append(facts, "**Total:** " + FormatDuration(*(recipe.TotalTime)))
+  }
+  if len(facts) > 0 {
+    text.WriteString(strings.Join(facts, " · ") + "\n\n")
+  }
+
+  if len(recipe.Ingredients) > 0 {
+    text.WriteString("## Ingredients\n\n")
+    for _, ingredient := range recipe.Ingredients {
+      text.WriteString("- " + escapeMarkdown(ingredient.Line()) + "\n")
+    }
+    text.WriteString("\n")
+  }
+
+  if len(recipe.Steps) > 0 {
+    text.WriteString("## Steps\n\n")
+    for idx, step := range recipe.Steps {
+      line := strconv.Itoa(idx + 1) + ". " + escapeMarkdown(step.Text)
+      if step.Duration != nil {
+        line += " *(" + FormatDuration(*(step.Duration)) + ")*"
+      }
+      text.WriteString(line + "\n")
+    }
+    text.WriteString("\n")
+  }
+
+  if len(recipe.Tags) > 0 {
+    tags := make([]string, len(recipe.Tags))
+    for idx, tag := range recipe.Tags {
+      tags[idx] = "*" + escapeMarkdown(tag) + "*"
+    }
+    text.WriteString("Tags: " + strings.Join(tags, ", ") + "\n")
+  }
+  return strings.TrimRight(text.String(), "\n") + "\n"
+}
+
+// Recipe cards separated by horizontal rules
+func MarkdownList(recipes []Recipe) string {
+  cards := make([]string, len(recipes))
+  for idx := range recipes {
+    cards[idx] = recipes[idx].Markdown()
+  }
+  return strings.Join(cards, "\n---\n\n")
+}
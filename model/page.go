@@ -0,0 +1,70 @@
+package model
+
+import (
+  "encoding/base64"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Ids per IN (...) query, stays below the SQLite variable limit
+const idBatchSize = 500
+
+func pageCount(total, limit int) int {
+  return (total + limit - 1) / limit
+}
+
+// Calls fn for batches of ids with the placeholder list "(?,?,...)" and the
+// ids as arguments
+func forIdBatches(ids []int64, fn func(in string, args []interface{}) error) error {
+  for start := 0; start < len(ids); start += idBatchSize {
+    end := start + idBatchSize
+    if end > len(ids) {
+      end = len(ids)
+    }
+    args := make([]interface{}, end - start)
+    for idx, id := range ids[start:end] {
+      args[idx] = id
+    }
+    err := fn("(?" + strings.Repeat(",?", len(args) - 1) + ")", args)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func whereClause(conditions []string) string {
+  if len(conditions) == 0 {
+    return ""
+  }
+  return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// Cursors are opaque to clients, they hold the last id of the previous page
+// and the direction they were made for
+func encodeCursor(id int64, descending bool) string {
+  direction := "asc"
+  if descending {
+    direction = "desc"
+  }
+  return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10) + ":" + direction))
+}
+
+func decodeCursor(cursor string, descending bool) (int64, error) {
+  bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+  if err != nil {
+    return 0, ErrInvalidCursor
+  }
+  parts := strings.Split(string(bytes), ":")
+  if len(parts) != 2 || (parts[1] == "desc") != descending {
+    return 0, ErrInvalidCursor
+  }
+  id, err := strconv.ParseInt(parts[0], 10, 64)
+  if err != nil {
+    return 0, ErrInvalidCursor
+  }
+  return id, nil
+}
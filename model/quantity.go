@@ -0,0 +1,162 @@
+package model
+
+import (
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+var vulgarFractions = map[rune]float64{
+  '½': 1.0 / 2, '⅓': 1.0 / 3, '⅔': 2.0 / 3, '¼': 1.0 / 4, '¾': 3.0 / 4,
+  '⅕': 1.0 / 5, '⅖': 2.0 / 5, '⅗': 3.0 / 5, '⅘': 4.0 / 5, '⅙': 1.0 / 6,
+  '⅚': 5.0 / 6, '⅛': 1.0 / 8, '⅜': 3.0 / 8, '⅝': 5.0 / 8, '⅞': 7.0 / 8,
+}
+
+// Splits a number glued to its unit like "200g" or "1½cups"
+var numberUnitGlue = regexp.MustCompile(`^([0-9.,/½⅓⅔¼¾⅕⅖⅗⅘⅙⅚⅛⅜⅝⅞]+)([^0-9.,/\s])`)
+
+type Quantity struct {
+  Amount float64
+  Unit string
+  Note string
+}
+
+// Parses texts like "200 g", "2 tbsp", "1 1/2 cups, sifted" or "3 (large)".
+// Returns false if the text is not fully understood.
+func ParseQuantity(text string) (Quantity, bool) {
+  quantity := Quantity{}
+  main, note := splitNote(strings.TrimSpace(text))
+  quantity.Note = note
+
+  main = numberUnitGlue.ReplaceAllString(main, "$1 $2")
+  fields := strings.Fields(main)
+  if len(fields) == 0 {
+    return quantity, false
+  }
+
+  amount, ok := parseNumber(fields[0])
+  if ! ok {
+    return quantity, false
+  }
+  fields = fields[1:]
+  // Mixed numbers like "1 1/2" or "1 ½"
+  if len(fields) > 0 && amount == math.Trunc(amount) && ! strings.ContainsAny(fields[0], ".,") {
+    if fraction, ok := parseNumber(fields[0]); ok && fraction < 1 {
+      amount += fraction
+      fields = fields[1:]
+    }
+  }
+  quantity.Amount = amount
+
+  if len(fields) > 0 {
+    unit, ok := LookupUnit(strings.Join(fields, " "))
+    if ! ok {
+      return quantity, false
+    }
+    quantity.Unit = unit.Name
+  }
+  return quantity, true
+}
+
+// Parses "2", "1.5", "1,5", "1/2", "½" and "1½"
+func parseNumber(text string) (float64, bool) {
+  runes := []rune(text)
+  if len(runes) == 0 {
+    return 0, false
+  }
+  if fraction, ok := vulgarFractions[runes[len(runes) - 1]]; ok {
+    if len(runes) == 1 {
+      return fraction, true
+    }
+    whole, ok := parseDigits(string(runes[:len(runes) - 1]))
+    if ! ok {
+      return 0, false
+    }
+    return float64(whole) + fraction, true
+  }
+  if parts := strings.Split(text, "/"); len(parts) == 2 {
+    numerator, ok := parseDigits(parts[0])
+    if ! ok {
+      return 0, false
+    }
+    denominator, ok := parseDigits(parts[1])
+    if ! ok || denominator == 0 {
+      return 0, false
+    }
+    return float64(numerator) / float64(denominator), true
+  }
+  value, err := strconv.ParseFloat(strings.Replace(text, ",", ".", 1), 64)
+  if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+    return 0, false
+  }
+  return value, true
+}
+
+// Plain decimal digits, signs are no part of a quantity
+func parseDigits(text string) (int, bool) {
+  if text == "" || strings.TrimLeft(text, "0123456789") != "" {
+    return 0, false
+  }
+  value, err := strconv.Atoi(text)
+  return value, err == nil
+}
+
+// Everything after a comma that is no decimal comma, or in parentheses,
+// is a note like "finely chopped"
+func splitNote(text string) (string, string) {
+  runes := []rune(text)
+  for idx, r := range runes {
+    switch r {
+    case ',':
+      if idx > 0 && idx + 1 < len(runes) && unicode.IsDigit(runes[idx - 1]) && unicode.IsDigit(runes[idx + 1]) {
+        continue
+      }
+      return strings.TrimSpace(string(runes[:idx])), strings.TrimSpace(string(runes[idx + 1:]))
+    case '(':
+      note := strings.TrimSpace(string(runes[idx + 1:]))
+      note = strings.TrimSpace(strings.TrimSuffix(note, ")"))
+      return strings.TrimSpace(string(runes[:idx])), note
+    }
+  }
+  return text, ""
+}
+
+func FormatAmount(amount float64) string {
+  return strconv.FormatFloat(math.Round(amount * 100) / 100, 'f', -1, 64)
+}
+
+// Eighths are written as fractions like "1 1/2", except for metric units
+func FormatAmountForUnit(amount float64, unitName string) string {
+  if unit, ok := LookupUnit(unitName); ok && unit.System == SystemMetric {
+    return FormatAmount(amount)
+  }
+  eighths := amount * 8
+  if math.Abs(eighths - math.Round(eighths)) > 1e-9 || amount == math.Trunc(amount) {
+    return FormatAmount(amount)
+  }
+  whole := int(amount)
+  numerator := int(math.Round(eighths)) - whole * 8
+  denominator := 8
+  for numerator % 2 == 0 {
+    numerator /= 2
+    denominator /= 2
+  }
+  fraction := strconv.Itoa(numerator) + "/" + strconv.Itoa(denominator)
+  if whole == 0 {
+    return fraction
+  }
+  return strconv.Itoa(whole) + " " + fraction
+}
+
+func (quantity Quantity) String() string {
+  text := FormatAmountForUnit(quantity.Amount, quantity.Unit)
+  if quantity.Unit != "" {
+    text += " " + quantity.Unit
+  }
+  if quantity.Note != "" {
+    text += ", " + quantity.Note
+  }
+  return text
+}
@@ -0,0 +1,64 @@
+package model
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+  tests := []struct {
+    text string
+    want Quantity
+    ok bool
+  }{
+    {"200 g", Quantity{Amount: 200, Unit: "g"}, true},
+    {"200g", Quantity{Amount: 200, Unit: "g"}, true},
+    {"1,5 l", Quantity{Amount: 1.5, Unit: "l"}, true},
+    {"0.25 kg", Quantity{Amount: 0.25, Unit: "kg"}, true},
+    {"2 Tbsp.", Quantity{Amount: 2, Unit: "tbsp"}, true},
+    {"2 fl oz", Quantity{Amount: 2, Unit: "fl oz"}, true},
+    {"3", Quantity{Amount: 3}, true},
+
+    // Vulgar and plain fractions, mixed numbers
+    {"½ cup", Quantity{Amount: 0.5, Unit: "cup"}, true},
+    {"¾", Quantity{Amount: 0.75}, true},
+    {"1½ cups", Quantity{Amount: 1.5, Unit: "cup"}, true},
+    {"1 ½ tsp", Quantity{Amount: 1.5, Unit: "tsp"}, true},
+    {"1/2 tsp", Quantity{Amount: 0.5, Unit: "tsp"}, true},
+    {"1 1/2 cups", Quantity{Amount: 1.5, Unit: "cup"}, true},
+    {"2 3/4 lb", Quantity{Amount: 2.75, Unit: "lb"}, true},
+
+    // Notes after a comma or in parentheses
+    {"1 1/2 cups, sifted", Quantity{Amount: 1.5, Unit: "cup", Note: "sifted"}, true},
+    {"3 (large)", Quantity{Amount: 3, Note: "large"}, true},
+    {"100 g (about 1 cup)", Quantity{Amount: 100, Unit: "g", Note: "about 1 cup"}, true},
+    {"2 cloves, finely chopped", Quantity{Amount: 2, Unit: "clove", Note: "finely chopped"}, true},
+
+    // Ranges aren't understood and stay plain text
+    {"2-3 cups", Quantity{}, false},
+    {"2 - 3 tbsp", Quantity{}, false},
+    {"2 to 3 tbsp", Quantity{}, false},
+
+    // Unknown units and other text
+    {"2 handfuls of love", Quantity{}, false},
+    {"3 eggs", Quantity{}, false},
+    {"a pinch", Quantity{}, false},
+    {"to taste", Quantity{}, false},
+    {"", Quantity{}, false},
+
+    // Signs and broken fractions
+    {"-2 g", Quantity{}, false},
+    {"-1/2 cup", Quantity{}, false},
+    {"1/-2 cup", Quantity{}, false},
+    {"+1/2 cup", Quantity{}, false},
+    {"-1½ cups", Quantity{}, false},
+    {"1/0 cup", Quantity{}, false},
+    {"1/2/3 cup", Quantity{}, false},
+  }
+
+  for _, test := range tests {
+    got, ok := ParseQuantity(test.text)
+    if ok != test.ok {
+      t.Errorf("ParseQuantity(%q) ok = %v, want %v", test.text, ok, test.ok)
+    } else if ok && got != test.want {
+      t.Errorf("ParseQuantity(%q) = %+v, want %+v", test.text, got, test.want)
+    }
+  }
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "time"
+)
+
+// Refresh tokens expire when they are not used for this long, every
+// refresh starts the period again
+const RefreshTokenLifetime = 30 * 24 * time.Hour
+
+var (
+  ErrInvalidRefreshToken = errors.New("invalid refresh token")
+  // A used or revoked token was presented again, the family is revoked
+  ErrRefreshTokenReuse = errors.New("refresh token reused")
+)
+
+type RefreshToken struct {
+  ID int64
+  Family string
+  User int64
+  CreatedAt time.Time
+  ExpiresAt time.Time
+  UsedAt *time.Time
+  RevokedAt *time.Time
+}
+
+func randomToken() (string, error) {
+  data := make([]byte, 32)
+  _, err := rand.Read(data)
+  if err != nil {
+    return "", err
+  }
+  return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func hashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// Starts a new token family for a login, returns the stored token and its
+// value which is only known to the client
+func NewRefreshToken(tx *sql.Tx, userId int64) (*RefreshToken, string, error) {
+  family, err := randomToken()
+  if err != nil {
+    return nil, "", err
+  }
+  return issueRefreshToken(tx, userId, family)
+}
+
+func issueRefreshToken(tx *sql.Tx, userId int64, family string) (*RefreshToken, string, error) {
+  token, err := randomToken()
+  if err != nil {
+    return nil, "", err
+  }
+  now := time.Now().UTC()
+  stored := &RefreshToken{
+    Family: family,
+    User: userId,
+    CreatedAt: now,
+    ExpiresAt: now.Add(RefreshTokenLifetime),
+  }
+  result, err := tx.Exec("INSERT INTO `refresh_token` (`hash`, `family`, `user`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?)",
+    hashToken(token), stored.Family, stored.User, stored.CreatedAt, stored.ExpiresAt)
+  if err != nil {
+    return nil, "", err
+  }
+  stored.ID, err = result.LastInsertId()
+  return stored, token, err
+}
+
+// Exchanges a refresh token for a new one of the same family. Returns the
+// new stored token and its value. Presenting a token that was already used
+// revokes the whole family and returns the old token with
+// ErrRefreshTokenReuse, the caller has to commit to keep the revocation.
+func RotateRefreshToken(tx *sql.Tx, token string) (*RefreshToken, string, error) {
+  stored := &RefreshToken{}
+  row := tx.QueryRow("SELECT `id`, `family`, `user`, `created_at`, `expires_at`, `used_at`, `revoked_at` FROM `refresh_token` WHERE `hash` = ?", hashToken(token))
+  err := row.Scan(&(stored.ID), &(stored.Family), &(stored.User), &(stored.CreatedAt), &(stored.ExpiresAt), &(stored.UsedAt), &(stored.RevokedAt))
+  if err == sql.ErrNoRows {
+    return nil, "", ErrInvalidRefreshToken
+  } else if err != nil {
+    return nil, "", err
+  }
+
+  now := time.Now().UTC()
+  if stored.RevokedAt != nil {
+    return nil, "", ErrInvalidRefreshToken
+  }
+  if stored.UsedAt != nil {
+    err = RevokeRefreshFamily(tx, stored.Family)
+    if err != nil {
+      return nil, "", err
+    }
+    return stored, "", ErrRefreshTokenReuse
+  }
+  if stored.ExpiresAt.Before(now) {
+    return nil, "", ErrInvalidRefreshToken
+  }
+
+  // Guards against two requests using the same token at once
+  result, err := tx.Exec("UPDATE `refresh_token` SET `used_at` = ? WHERE `id` = ? AND `used_at` IS NULL", now, stored.ID)
+  if err != nil {
+    return nil, "", err
+  }
+  changed, err := result.RowsAffected()
+  if err != nil {
+    return nil, "", err
+  }
+  if changed == 0 {
+    err = RevokeRefreshFamily(tx, stored.Family)
+    if err != nil {
+      return nil, "", err
+    }
+    return stored, "", ErrRefreshTokenReuse
+  }
+
+  return issueRefreshToken(tx, stored.User, stored.Family)
+}
+
+func RevokeRefreshFamily(tx *sql.Tx, family string) error {
+  _, err := tx.Exec("UPDATE `refresh_token` SET `revoked_at` = ? WHERE `family` = ? AND `revoked_at` IS NULL",
+    time.Now().UTC(), family)
+  return err
+}
+
+// Removes expired tokens, a family is kept as long as one of its tokens
+// is valid so a replay is still detected
+func DeleteExpiredRefreshTokens(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `refresh_token` WHERE `family` NOT IN (SELECT `family` FROM `refresh_token` WHERE `expires_at` >= ? AND `revoked_at` IS NULL)",
+    time.Now().UTC())
+  return err
+}
@@ -2,67 +2,311 @@ package model
 
 import (
   "database/sql"
+  "errors"
+  "strings"
+  "time"
 )
 
 type Recipe struct {
   ID int64 `json:"id"`
   Title string `json:"title"`
   Description string `json:"description"`
+  Servings int `json:"servings"`
+  // Times in seconds, null if unknown
+  PrepTime *int64 `json:"prepTime"`
+  CookTime *int64 `json:"cookTime"`
+  TotalTime *int64 `json:"totalTime"`
+  CreatedBy int64 `json:"createdBy"`
+  UpdatedBy int64 `json:"updatedBy"`
+  CreatedAt time.Time `json:"createdAt"`
+  UpdatedAt time.Time `json:"updatedAt"`
+  // Counts up with every change, used as ETag
+  Version int `json:"version"`
+  // Only set for recipes in the trash
+  DeletedAt *time.Time `json:"deletedAt,omitempty"`
+  DeletedBy *int64 `json:"deletedBy,omitempty"`
   Ingredients []Ingredient `json:"ingredients"`
+  Steps []Step `json:"steps"`
+  Tags []string `json:"tags"`
+  Images []Image `json:"images"`
 }
 
 type RecipeListPage struct {
   List []Recipe `json:"list"`
   Limit int `json:"limit"`
-  Page int `json:"page"`
+  Page int `json:"page,omitempty"`
+  Cursor string `json:"cursor,omitempty"`
+  Total int `json:"total"`
+  Pages int `json:"pages"`
+  HasNext bool `json:"hasNext"`
+  NextCursor string `json:"nextCursor,omitempty"`
 }
 
-func GetListPage(tx *sql.Tx, page, limit int) (* RecipeListPage, error) {
+// Columns read by scanRecipe, in order
+const recipeColumns = "`recipe`.`id`, `recipe`.`title`, `recipe`.`description`, `recipe`.`servings`, " +
+  "`recipe`.`prep_time`, `recipe`.`cook_time`, `recipe`.`total_time`, " +
+  "`recipe`.`created_by`, `recipe`.`updated_by`, `recipe`.`created_at`, `recipe`.`updated_at`, " +
+  "`recipe`.`deleted_at`, `recipe`.`deleted_by`, `recipe`.`version`"
 
-  list := RecipeListPage{Limit: limit, Page: page, List: []Recipe{}}
+// Recipes in the trash are hidden everywhere except the trash itself
+const recipeLive = "`recipe`.`deleted_at` IS NULL"
 
-  rows, err := tx.Query("SELECT `id`, `title`, `description` FROM `recipe` LIMIT ?,?", limit * (page - 1), limit)
+type scanner interface {
+  Scan(dest ...interface{}) error
+}
+
+// Scans recipeColumns followed by the given extra columns
+func scanRecipe(row scanner, recipe *Recipe, extra ...interface{}) error {
+  dest := []interface{}{&(recipe.ID), &(recipe.Title), &(recipe.Description), &(recipe.Servings),
+    &(recipe.PrepTime), &(recipe.CookTime), &(recipe.TotalTime),
+    &(recipe.CreatedBy), &(recipe.UpdatedBy), &(recipe.CreatedAt), &(recipe.UpdatedAt),
+    &(recipe.DeletedAt), &(recipe.DeletedBy), &(recipe.Version)}
+  return row.Scan(append(dest, extra...)...)
+}
+
+var recipeSortColumns = map[string]string{
+  "id": "`recipe`.`id`",
+  "title": "`recipe`.`title` COLLATE NOCASE",
+  "created": "`recipe`.`created_at`",
+  "updated": "`recipe`.`updated_at`",
+}
+
+// Sorting and filtering of the recipe list
+type RecipeQuery struct {
+  Sort string
+  Descending bool
+  Ingredients []string
+  ExcludeIngredients []string
+  TitlePrefix string
+  Tags []string
+}
+
+func ValidRecipeSort(sort string) bool {
+  _, ok := recipeSortColumns[sort]
+  return ok
+}
+
+func escapeLike(text string) string {
+  return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(text)
+}
+
+// Builds the filter conditions and their arguments
+func (query *RecipeQuery) conditions() ([]string, []interface{}) {
+  conditions := []string{recipeLive}
+  var args []interface{}
+
+  ingredientMatch := "SELECT 1 FROM `ingredient` WHERE `ingredient`.`recipe` = `recipe`.`id` " +
+    "AND `ingredient`.`name` LIKE ? ESCAPE '\\'"
+  for _, name := range query.Ingredients {
+    conditions = append(conditions, "EXISTS (" + ingredientMatch + ")")
+    args = append(args, "%" + escapeLike(name) + "%")
+  }
+  for _, name := range query.ExcludeIngredients {
+    conditions = append(conditions, "NOT EXISTS (" + ingredientMatch + ")")
+    args = append(args, "%" + escapeLike(name) + "%")
+  }
+  if query.TitlePrefix != "" {
+    conditions = append(conditions, "`recipe`.`title` LIKE ? ESCAPE '\\'")
+    args = append(args, escapeLike(query.TitlePrefix) + "%")
+  }
+  for _, tag := range query.Tags {
+    conditions = append(conditions, "EXISTS (SELECT 1 FROM `recipe_tag` " +
+      "JOIN `tag` ON `tag`.`id` = `recipe_tag`.`tag` " +
+      "WHERE `recipe_tag`.`recipe` = `recipe`.`id` AND `tag`.`name` = ?)")
+    args = append(args, NormalizeTag(tag))
+  }
+  return conditions, args
+}
+
+// The id is always the last sort key so pages are stable
+func (query *RecipeQuery) orderBy() (string, error) {
+  sort := query.Sort
+  if sort == "" {
+    sort = "id"
+  }
+  column, ok := recipeSortColumns[sort]
+  if ! ok {
+    return "", errors.New("invalid sort " + sort)
+  }
+  direction := " ASC"
+  if query.Descending {
+    direction = " DESC"
+  }
+  order := " ORDER BY " + column + direction
+  if sort != "id" {
+    order += ", `recipe`.`id`" + direction
+  }
+  return order, nil
+}
+
+func GetListPage(tx *sql.Tx, page, limit int, query *RecipeQuery) (* RecipeListPage, error) {
+
+  list := RecipeListPage{Limit: limit, Page: page}
+
+  conditions, args := query.conditions()
+  where := whereClause(conditions)
+  order, err := query.orderBy()
   if err != nil {
     return nil, err
   }
-  defer rows.Close()
-  for rows.Next() {
-    recipe := Recipe{}
-    err = rows.Scan(&(recipe.ID), &(recipe.Title), &(recipe.Description))
+
+  err = tx.QueryRow("SELECT COUNT(*) FROM `recipe`" + where, args...).Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+  list.HasNext = page < list.Pages
+
+  args = append(args, limit * (page - 1), limit)
+  list.List, err = queryRecipes(tx,
+    "SELECT " + recipeColumns + " FROM `recipe`" + where + order + " LIMIT ?,?", args...)
+  if err != nil {
+    return nil, err
+  }
+  return &list, nil
+}
+
+// Keyset paging on the recipe id, an empty cursor starts at the beginning.
+// The sort of the query is ignored, cursors only work in id order.
+func GetListCursor(tx *sql.Tx, cursor string, limit int, query *RecipeQuery) (* RecipeListPage, error) {
+
+  list := RecipeListPage{Limit: limit, Cursor: cursor}
+
+  conditions, args := query.conditions()
+  err := tx.QueryRow("SELECT COUNT(*) FROM `recipe`" + whereClause(conditions), args...).Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+
+  if cursor != "" {
+    after, err := decodeCursor(cursor, query.Descending)
     if err != nil {
       return nil, err
     }
-    ingredients, err := GetIngrediants(tx, recipe.ID)
+    if query.Descending {
+      conditions = append(conditions, "`recipe`.`id` < ?")
+    } else {
+      conditions = append(conditions, "`recipe`.`id` > ?")
+    }
+    args = append(args, after)
+  }
+  idQuery := RecipeQuery{Descending: query.Descending}
+  order, err := idQuery.orderBy()
+  if err != nil {
+    return nil, err
+  }
+
+  // One more row than needed tells if there is a next page
+  args = append(args, limit + 1)
+  list.List, err = queryRecipes(tx,
+    "SELECT " + recipeColumns + " FROM `recipe`" + whereClause(conditions) + order + " LIMIT ?", args...)
+  if err != nil {
+    return nil, err
+  }
+  if len(list.List) > limit {
+    list.List = list.List[:limit]
+    list.HasNext = true
+    list.NextCursor = encodeCursor(list.List[limit - 1].ID, query.Descending)
+  }
+  return &list, nil
+}
+
+func queryRecipes(tx *sql.Tx, query string, args ...interface{}) ([]Recipe, error) {
+  list := []Recipe{}
+  rows, err := tx.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    recipe := Recipe{}
+    err = scanRecipe(rows, &recipe)
     if err != nil {
       return nil, err
     }
-    recipe.Ingredients = *ingredients
-    list.List = append(list.List, recipe)
+    list = append(list, recipe)
   }
   err = rows.Err()
   if err != nil {
     return nil, err
   }
+  rows.Close()
 
-  return &list, nil
+  recipes := make([]*Recipe, len(list))
+  for idx := range list {
+    recipes[idx] = &list[idx]
+  }
+  err = loadRelations(tx, recipes)
+  if err != nil {
+    return nil, err
+  }
+  return list, nil
+}
+
+// Fills ingredients, steps, tags and images of all given recipes with
+// batched queries
+func loadRelations(tx *sql.Tx, recipes []*Recipe) error {
+  ids := make([]int64, len(recipes))
+  for idx, recipe := range recipes {
+    ids[idx] = recipe.ID
+  }
+  ingredients, err := GetIngrediantsForRecipes(tx, ids)
+  if err != nil {
+    return err
+  }
+  steps, err := GetStepsForRecipes(tx, ids)
+  if err != nil {
+    return err
+  }
+  tags, err := GetTagsForRecipes(tx, ids)
+  if err != nil {
+    return err
+  }
+  images, err := GetImagesForRecipes(tx, ids)
+  if err != nil {
+    return err
+  }
+  for _, recipe := range recipes {
+    recipe.Ingredients = ingredients[recipe.ID]
+    recipe.Steps = steps[recipe.ID]
+    recipe.Tags = tags[recipe.ID]
+    recipe.Images = images[recipe.ID]
+  }
+  return nil
 }
 
 func GetRecipeById(tx *sql.Tx, id int64) (*Recipe, error) {
   recipe := &Recipe{}
-  row := tx.QueryRow("SELECT `id`, `title`, `description` FROM `recipe` WHERE `id` = ?", id)
-  err := row.Scan(&(recipe.ID), &(recipe.Title), &(recipe.Description))
+  row := tx.QueryRow("SELECT " + recipeColumns + " FROM `recipe` WHERE `id` = ? AND " + recipeLive, id)
+  err := scanRecipe(row, recipe)
   if err != nil {
     return nil, err
   }
-  ingredients, err := GetIngrediants(tx, id)
+  err = loadRelations(tx, []*Recipe{recipe})
   if err != nil {
     return nil, err
   }
-  recipe.Ingredients = *ingredients
   return recipe, nil
 }
 
+func (recipe *Recipe)CanModify(user *User) bool {
+  return user.IsAdmin() || recipe.CreatedBy == user.ID
+}
+
+// UpdatedBy has to be set to the user deleting the recipe
 func (recipe *Recipe)Delete(tx *sql.Tx) error {
+  err := recipe.saveRevision(tx, RevisionDelete)
+  if err != nil {
+    return err
+  }
+
+  for _, step := range recipe.Steps {
+    err := step.Delete(tx)
+    if err != nil {
+      return err
+    }
+  }
 
   for _, ingredient := range recipe.Ingredients {
     err := ingredient.Delete(tx)
@@ -71,14 +315,113 @@ func (recipe *Recipe)Delete(tx *sql.Tx) error {
     }
   }
 
-  _, err := tx.Exec("DELETE FROM `recipe` WHERE `id` = ?", recipe.ID)
+  for _, image := range recipe.Images {
+    err := image.Delete(tx)
+    if err != nil {
+      return err
+    }
+  }
+
+  recipe.Tags = nil
+  err = recipe.saveTags(tx)
+  if err != nil {
+    return err
+  }
+
+  err = recipe.unindex(tx)
+  if err != nil {
+    return err
+  }
+
+  _, err = tx.Exec("DELETE FROM `recipe` WHERE `id` = ?", recipe.ID)
   return err
 }
 
+func (recipe *Recipe)Validate() error {
+  if recipe.Servings < 0 {
+    return ValidationError("servings can't be negative")
+  }
+  for _, duration := range []*int64{recipe.PrepTime, recipe.CookTime, recipe.TotalTime} {
+    if duration != nil && *duration < 0 {
+      return ValidationError("times can't be negative")
+    }
+  }
+  for _, ingredient := range recipe.Ingredients {
+    err := ingredient.Validate()
+    if err != nil {
+      return err
+    }
+  }
+  for _, step := range recipe.Steps {
+    err := step.Validate()
+    if err != nil {
+      return err
+    }
+  }
+  for _, tag := range recipe.Tags {
+    err := ValidateTag(NormalizeTag(tag))
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Rescales the ingredients to the given servings, ingredients without
+// parsed amount stay as they are. Only for output, don't store the result.
+func (recipe *Recipe)Scale(servings int) error {
+  if recipe.Servings <= 0 {
+    return errors.New("recipe has no servings to scale from")
+  }
+  if servings <= 0 {
+    return errors.New("servings must be positive")
+  }
+  factor := float64(servings) / float64(recipe.Servings)
+  for idx := range recipe.Ingredients {
+    ingredient := &(recipe.Ingredients[idx])
+    if ingredient.Amount == nil {
+      continue
+    }
+    amount := RoundAmount(*(ingredient.Amount) * factor, ingredient.Unit)
+    ingredient.Amount = &amount
+    ingredient.Quantity = Quantity{amount, ingredient.Unit, ingredient.Note}.String()
+  }
+  recipe.Servings = servings
+  return nil
+}
+
+func (recipe *Recipe)normalizeIngredients() {
+  for idx := range recipe.Ingredients {
+    recipe.Ingredients[idx].normalize()
+  }
+}
+
 func (recipe *Recipe)Create(tx *sql.Tx) error {
+  recipe.ID = 0
+  recipe.Version = 0
+  recipe.CreatedAt = time.Now().UTC()
+  recipe.UpdatedAt = recipe.CreatedAt
+  return recipe.insert(tx, RevisionCreate)
+}
+
+// Inserts the recipe with its ingredients, steps and tags. A non zero id
+// and the timestamps are stored as they are, the version counts up from
+// the given one.
+func (recipe *Recipe)insert(tx *sql.Tx, action string) error {
+  err := recipe.refIngredientsByPosition()
+  if err != nil {
+    return err
+  }
+  recipe.normalizeIngredients()
+  recipe.Version++
+  var id interface{}
+  if recipe.ID != 0 {
+    id = recipe.ID
+  }
   result, err := tx.Exec(
-    "INSERT INTO `recipe` (`title`, `description`) VALUES (?,?)",
-    recipe.Title, recipe.Description)
+    "INSERT INTO `recipe` (`id`, `title`, `description`, `servings`, `prep_time`, `cook_time`, `total_time`, " +
+    "`created_by`, `updated_by`, `created_at`, `updated_at`, `version`) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+    id, recipe.Title, recipe.Description, recipe.Servings, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, recipe.CreatedBy, recipe.UpdatedBy, recipe.CreatedAt, recipe.UpdatedAt, recipe.Version)
   if err != nil {
     return err
   }
@@ -94,16 +437,66 @@ func (recipe *Recipe)Create(tx *sql.Tx) error {
     }
     recipe.Ingredients[idx] = ingredient
   }
-  return nil
+
+  for idx, step := range recipe.Steps {
+    err := step.Create(tx, recipe, idx)
+    if err != nil {
+      return err
+    }
+    recipe.Steps[idx] = step
+  }
+
+  err = recipe.saveTags(tx)
+  if err != nil {
+    return err
+  }
+  err = recipe.index(tx)
+  if err != nil {
+    return err
+  }
+  if action == RevisionCreate {
+    // An import can create a recipe with the id of a deleted one, its
+    // revisions don't belong to the new recipe
+    err = deleteRevisions(tx, recipe.ID)
+    if err != nil {
+      return err
+    }
+  }
+  return recipe.saveRevision(tx, action)
 }
 
+// Version has to be the stored version the change is based on, otherwise
+// ErrVersionConflict is returned
 func (recipe *Recipe)Update(tx *sql.Tx) error {
-  _, err := tx.Exec(
-    "UPDATE `recipe` SET `title` = ?, `description` = ? WHERE `id` = ?",
-    recipe.Title, recipe.Description, recipe.ID)
+  return recipe.update(tx, RevisionUpdate)
+}
+
+func (recipe *Recipe)update(tx *sql.Tx, action string) error {
+  err := recipe.refIngredientsByPosition()
+  if err != nil {
+    return err
+  }
+  err = recipe.saveInitialRevision(tx)
+  if err != nil {
+    return err
+  }
+  recipe.normalizeIngredients()
+  recipe.UpdatedAt = time.Now().UTC()
+  result, err := tx.Exec(
+    "UPDATE `recipe` SET `title` = ?, `description` = ?, `servings` = ?, `prep_time` = ?, `cook_time` = ?, " +
+    "`total_time` = ?, `updated_by` = ?, `updated_at` = ?, `version` = `version` + 1 WHERE `id` = ? AND `version` = ?",
+    recipe.Title, recipe.Description, recipe.Servings, recipe.PrepTime, recipe.CookTime, recipe.TotalTime, recipe.UpdatedBy, recipe.UpdatedAt, recipe.ID, recipe.Version)
+  if err != nil {
+    return err
+  }
+  changed, err := result.RowsAffected()
   if err != nil {
     return err
   }
+  if changed == 0 {
+    return ErrVersionConflict
+  }
+  recipe.Version++
 
   ingredients, err := GetIngrediants(tx, recipe.ID)
   if err != nil {
@@ -140,5 +533,50 @@ func (recipe *Recipe)Update(tx *sql.Tx) error {
       return err
     }
   }
-  return nil
+
+  steps, err := GetSteps(tx, recipe.ID)
+  if err != nil {
+    return err
+  }
+  for _, step := range steps {
+    found := false
+    for _, stepNew := range recipe.Steps {
+      if step.ID == stepNew.ID {
+        found = true
+        break
+      }
+    }
+    if ! found {
+      err := step.Delete(tx)
+      if err != nil {
+        return err
+      }
+    }
+  }
+
+  for idx, step := range recipe.Steps {
+    found, err := HasStepForRecipe(tx, step.ID, recipe.ID)
+    if err != nil {
+      return err
+    }
+    if found {
+      err = step.Update(tx, recipe, idx)
+    } else {
+      err = step.Create(tx, recipe, idx)
+    }
+    recipe.Steps[idx] = step
+    if err != nil {
+      return err
+    }
+  }
+
+  err = recipe.saveTags(tx)
+  if err != nil {
+    return err
+  }
+  err = recipe.index(tx)
+  if err != nil {
+    return err
+  }
+  return recipe.saveRevision(tx, action)
 }
@@ -0,0 +1,143 @@
+package model
+
+import (
+  "database/sql"
+  "encoding/json"
+  "time"
+)
+
+const (
+  RevisionCreate = "create"
+  RevisionUpdate = "update"
+  RevisionDelete = "delete"
+  RevisionRestore = "restore"
+)
+
+// A stored state of a recipe, Recipe is only filled when a single
+// revision is loaded
+type Revision struct {
+  RecipeID int64 `json:"recipeId"`
+  Number int `json:"number"`
+  Action string `json:"action"`
+  CreatedBy int64 `json:"createdBy"`
+  CreatedAt time.Time `json:"createdAt"`
+  Recipe *Recipe `json:"recipe,omitempty"`
+}
+
+// Writes the current state of the recipe as next revision
+func (recipe *Recipe)saveRevision(tx *sql.Tx, action string) error {
+  snapshot, err := json.Marshal(recipe)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(
+    "INSERT INTO `revision` (`recipe`, `number`, `action`, `snapshot`, `created_by`, `created_at`) " +
+    "SELECT ?, COALESCE(MAX(`number`), 0) + 1, ?, ?, ?, ? FROM `revision` WHERE `recipe` = ?",
+    recipe.ID, action, string(snapshot), recipe.UpdatedBy, time.Now().UTC(), recipe.ID)
+  return err
+}
+
+func deleteRevisions(tx *sql.Tx, recipeId int64) error {
+  _, err := tx.Exec("DELETE FROM `revision` WHERE `recipe` = ?", recipeId)
+  return err
+}
+
+// Recipes stored before revisions existed get their stored state as first
+// revision before it changes
+func (recipe *Recipe)saveInitialRevision(tx *sql.Tx) error {
+  var count int
+  err := tx.QueryRow("SELECT COUNT(*) FROM `revision` WHERE `recipe` = ?", recipe.ID).Scan(&count)
+  if err != nil || count > 0 {
+    return err
+  }
+  stored, err := GetRecipeById(tx, recipe.ID)
+  if err == sql.ErrNoRows {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  return stored.saveRevision(tx, RevisionCreate)
+}
+
+// All revisions of a recipe without snapshot, newest first
+func GetRevisions(tx *sql.Tx, recipeId int64) ([]Revision, error) {
+  list := []Revision{}
+  rows, err := tx.Query(
+    "SELECT `recipe`, `number`, `action`, `created_by`, `created_at` FROM `revision` " +
+    "WHERE `recipe` = ? ORDER BY `number` DESC", recipeId)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    revision := Revision{}
+    err = rows.Scan(&(revision.RecipeID), &(revision.Number), &(revision.Action),
+      &(revision.CreatedBy), &(revision.CreatedAt))
+    if err != nil {
+      return nil, err
+    }
+    list = append(list, revision)
+  }
+  err = rows.Err()
+  if err != nil {
+    return nil, err
+  }
+  return list, nil
+}
+
+// Loads a revision with its snapshot, number 0 is the latest revision
+func GetRevision(tx *sql.Tx, recipeId int64, number int) (*Revision, error) {
+  revision := &Revision{}
+  var snapshot string
+  query := "SELECT `recipe`, `number`, `action`, `snapshot`, `created_by`, `created_at` FROM `revision` WHERE `recipe` = ?"
+  args := []interface{}{recipeId}
+  if number == 0 {
+    query += " ORDER BY `number` DESC LIMIT 1"
+  } else {
+    query += " AND `number` = ?"
+    args = append(args, number)
+  }
+  err := tx.QueryRow(query, args...).Scan(&(revision.RecipeID), &(revision.Number), &(revision.Action),
+    &snapshot, &(revision.CreatedBy), &(revision.CreatedAt))
+  if err != nil {
+    return nil, err
+  }
+  revision.Recipe = &Recipe{}
+  err = json.Unmarshal([]byte(snapshot), revision.Recipe)
+  if err != nil {
+    return nil, err
+  }
+  return revision, nil
+}
+
+// Makes the snapshot of the revision the current recipe again, recipes in
+// the trash are taken out and deleted recipes are stored again with their
+// id. Images of the snapshot are ignored, the recipe keeps its images.
+func (revision *Revision)Restore(tx *sql.Tx, userId int64) (*Recipe, error) {
+  recipe := *(revision.Recipe)
+  recipe.ID = revision.RecipeID
+  recipe.resetRelationIds()
+  recipe.UpdatedBy = userId
+
+  existing, err := GetRecipeById(tx, recipe.ID)
+  if err == sql.ErrNoRows {
+    existing, err = GetTrashedRecipe(tx, recipe.ID)
+    if err == nil {
+      err = existing.clearTrash(tx)
+    }
+  }
+  if err == sql.ErrNoRows {
+    recipe.UpdatedAt = time.Now().UTC()
+    err = recipe.insert(tx, RevisionRestore)
+  } else if err == nil {
+    recipe.CreatedBy = existing.CreatedBy
+    recipe.CreatedAt = existing.CreatedAt
+    recipe.Images = existing.Images
+    recipe.Version = existing.Version
+    err = recipe.update(tx, RevisionRestore)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return &recipe, nil
+}
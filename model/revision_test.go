@@ -0,0 +1,140 @@
+package model_test
+
+import (
+  "database/sql"
+  "io/ioutil"
+  "log"
+  "os"
+  "testing"
+  "github.com/hc42/food-api/library"
+  "github.com/hc42/food-api/model"
+)
+
+func createRecipe(t *testing.T, tx *sql.Tx, title string) *model.Recipe {
+  t.Helper()
+  recipe := &model.Recipe{Title: title, CreatedBy: 1, UpdatedBy: 1}
+  err := recipe.Create(tx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return recipe
+}
+
+func deleteRecipe(t *testing.T, tx *sql.Tx, id int64) {
+  t.Helper()
+  recipe, err := model.GetRecipeById(tx, id)
+  if err != nil {
+    t.Fatal(err)
+  }
+  recipe.UpdatedBy = 1
+  err = recipe.Delete(tx)
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func countRevisions(t *testing.T, tx *sql.Tx, id int64) int {
+  t.Helper()
+  list, err := model.GetRevisions(tx, id)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return len(list)
+}
+
+func TestDeletedRecipeIdNotReused(t *testing.T) {
+  tempDatabase(t)
+  withTransaction(t, func(tx *sql.Tx) error {
+    createRecipe(t, tx, "First")
+    newest := createRecipe(t, tx, "Newest")
+    deleteRecipe(t, tx, newest.ID)
+
+    recipe := createRecipe(t, tx, "Next")
+    if recipe.ID == newest.ID {
+      t.Errorf("new recipe got id %d of the deleted one", recipe.ID)
+    }
+    if count := countRevisions(t, tx, recipe.ID); count != 1 {
+      t.Errorf("new recipe has %d revisions, want 1", count)
+    }
+    if count := countRevisions(t, tx, newest.ID); count != 2 {
+      t.Errorf("deleted recipe has %d revisions, want 2", count)
+    }
+    return nil
+  })
+}
+
+func TestImportDropsRevisionsOfDeletedRecipe(t *testing.T) {
+  tempDatabase(t)
+  withTransaction(t, func(tx *sql.Tx) error {
+    deleted := createRecipe(t, tx, "Deleted")
+    deleteRecipe(t, tx, deleted.ID)
+
+    imported := &model.Recipe{ID: deleted.ID, Title: "Imported", CreatedBy: 1}
+    result := model.ImportResult{}
+    err := imported.Import(tx, model.ImportSkip, 1, &result)
+    if err != nil {
+      return err
+    }
+    if imported.ID != deleted.ID || result.Created != 1 {
+      t.Fatalf("import created %d recipes with id %d, want 1 with id %d", result.Created, imported.ID, deleted.ID)
+    }
+    revision, err := model.GetRevision(tx, imported.ID, 0)
+    if err != nil {
+      return err
+    }
+    if revision.Number != 1 || revision.Recipe.Title != "Imported" {
+      t.Errorf("latest revision is %d %q, want 1 \"Imported\"", revision.Number, revision.Recipe.Title)
+    }
+    return nil
+  })
+}
+
+// Ids of a table from before AUTOINCREMENT continue after every id that
+// has revisions
+func TestMigrateRecipeIds(t *testing.T) {
+  dir := t.TempDir()
+  cwd, _ := os.Getwd()
+  os.Chdir(dir)
+  defer os.Chdir(cwd)
+
+  db, err := library.ConnectDb()
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, statement := range []string{
+    "CREATE TABLE `recipe` (`id` INTEGER NOT NULL PRIMARY KEY, `title` VARCHAR(255) NOT NULL, `description` TEXT NOT NULL)",
+    "CREATE TABLE `revision` (`id` INTEGER NOT NULL PRIMARY KEY, `recipe` INTEGER NOT NULL, `number` INTEGER NOT NULL, " +
+      "`action` VARCHAR(16) NOT NULL, `snapshot` TEXT NOT NULL, `created_by` INTEGER NOT NULL, `created_at` DATETIME NOT NULL, " +
+      "UNIQUE(`recipe`, `number`))",
+    "INSERT INTO `recipe` (`id`, `title`, `description`) VALUES (1, 'Kept', '')",
+    "INSERT INTO `revision` (`recipe`, `number`, `action`, `snapshot`, `created_by`, `created_at`) " +
+      "VALUES (5, 1, 'delete', '{}', 1, CURRENT_TIMESTAMP)",
+  } {
+    _, err = db.Exec(statement)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  db.Close()
+
+  log.SetOutput(ioutil.Discard)
+  err = library.InitDb()
+  log.SetOutput(os.Stderr)
+  if err != nil && err != library.ErrNoFts5 {
+    t.Fatal(err)
+  }
+
+  withTransaction(t, func(tx *sql.Tx) error {
+    kept, err := model.GetRecipeById(tx, 1)
+    if err != nil {
+      return err
+    }
+    if kept.Title != "Kept" {
+      t.Errorf("recipe 1 is %q after the rebuild", kept.Title)
+    }
+    if recipe := createRecipe(t, tx, "New"); recipe.ID != 6 {
+      t.Errorf("new recipe got id %d, want 6", recipe.ID)
+    }
+    return nil
+  })
+}
@@ -0,0 +1,321 @@
+package model
+
+import (
+  "encoding/json"
+  "errors"
+  "html"
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+var ErrNoSchemaRecipe = errors.New("no schema.org Recipe found")
+
+var jsonLdScript = regexp.MustCompile(`(?is)<script[^>]*type\s*=\s*["']?application/ld\+json["']?[^>]*>(.*?)</script>`)
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// ISO 8601 durations like "PT1H30M" or "P0DT0H20M"
+var isoDuration = regexp.MustCompile(`^P(?:([0-9.]+)D)?(?:T(?:([0-9.]+)H)?(?:([0-9.]+)M)?(?:([0-9.]+)S)?)?$`)
+
+// Reads a recipe from a schema.org Recipe given as JSON-LD, or from the
+// JSON-LD scripts embedded in an HTML page. The recipe is not stored.
+func ParseSchemaRecipe(data []byte) (*Recipe, error) {
+  text := strings.TrimSpace(string(data))
+  var blocks []string
+  if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+    blocks = []string{text}
+  } else {
+    for _, match := range jsonLdScript.FindAllStringSubmatch(text, -1) {
+      blocks = append(blocks, match[1])
+    }
+  }
+
+  for _, block := range blocks {
+    var value interface{}
+    err := json.Unmarshal([]byte(strings.TrimSpace(block)), &value)
+    if err != nil {
+      continue
+    }
+    if node := findSchemaRecipe(value); node != nil {
+      return schemaRecipe(node), nil
+    }
+  }
+  return nil, ErrNoSchemaRecipe
+}
+
+// Searches arrays and @graph lists for the first node of type Recipe
+func findSchemaRecipe(value interface{}) map[string]interface{} {
+  switch v := value.(type) {
+  case []interface{}:
+    for _, item := range v {
+      if node := findSchemaRecipe(item); node != nil {
+        return node
+      }
+    }
+  case map[string]interface{}:
+    if hasSchemaType(v, "Recipe") {
+      return v
+    }
+    if graph, ok := v["@graph"]; ok {
+      return findSchemaRecipe(graph)
+    }
+  }
+  return nil
+}
+
+// @type is a string or a list, with or without schema.org prefix
+func hasSchemaType(node map[string]interface{}, name string) bool {
+  for _, t := range schemaStrings(node["@type"]) {
+    if t == name || strings.HasSuffix(t, "/" + name) {
+      return true
+    }
+  }
+  return false
+}
+
+func schemaRecipe(node map[string]interface{}) *Recipe {
+  recipe := &Recipe{
+    Title: schemaText(node["name"]),
+    Description: schemaText(node["description"]),
+    Ingredients: []Ingredient{},
+    Steps: []Step{},
+    Tags: []string{},
+    Images: []Image{},
+    PrepTime: ParseIsoDuration(schemaText(node["prepTime"])),
+    CookTime: ParseIsoDuration(schemaText(node["cookTime"])),
+    TotalTime: ParseIsoDuration(schemaText(node["totalTime"])),
+    Servings: schemaYield(node["recipeYield"]),
+  }
+
+  ingredients := node["recipeIngredient"]
+  if ingredients == nil {
+    ingredients = node["ingredients"]
+  }
+  for _, line := range schemaStrings(ingredients) {
+    line = cleanSchemaText(line)
+    if line != "" {
+      recipe.Ingredients = append(recipe.Ingredients, ParseIngredientLine(line))
+    }
+  }
+
+  recipe.Steps = schemaSteps(node["recipeInstructions"])
+
+  keywords := schemaStrings(node["keywords"])
+  keywords = append(keywords, schemaStrings(node["recipeCategory"])...)
+  keywords = append(keywords, schemaStrings(node["recipeCuisine"])...)
+  for _, keyword := range keywords {
+    for _, tag := range strings.Split(keyword, ",") {
+      tag = NormalizeTag(cleanSchemaText(tag))
+      if ValidateTag(tag) == nil {
+        recipe.Tags = append(recipe.Tags, tag)
+      }
+    }
+  }
+  return recipe
+}
+
+// Instructions come as one text, a list of texts, HowToStep objects or
+// HowToSection objects holding steps
+func schemaSteps(value interface{}) []Step {
+  steps := []Step{}
+  switch v := value.(type) {
+  case string:
+    for _, line := range strings.Split(html.UnescapeString(v), "\n") {
+      line = cleanSchemaText(line)
+      if line != "" {
+        steps = append(steps, Step{Text: line, Ingredients: []int64{}})
+      }
+    }
+  case []interface{}:
+    for _, item := range v {
+      steps = append(steps, schemaSteps(item)...)
+    }
+  case map[string]interface{}:
+    if elements, ok := v["itemListElement"]; ok {
+      return schemaSteps(elements)
+    }
+    text := cleanSchemaText(schemaText(v["text"]))
+    if text == "" {
+      text = cleanSchemaText(schemaText(v["name"]))
+    }
+    if text == "" {
+      return steps
+    }
+    step := Step{Text: text, Ingredients: []int64{}}
+    step.Duration = ParseIsoDuration(schemaText(v["totalTime"]))
+    if step.Duration == nil {
+      step.Duration = ParseIsoDuration(schemaText(v["performTime"]))
+    }
+    steps = append(steps, step)
+  }
+  return steps
+}
+
+// The first number of yields like "4", 4, "4 servings" or ["4", "4 cookies"]
+func schemaYield(value interface{}) int {
+  for _, text := range schemaStrings(value) {
+    for _, field := range strings.Fields(text) {
+      if number, err := strconv.Atoi(strings.Trim(field, "()")); err == nil && number > 0 {
+        return number
+      }
+    }
+  }
+  return 0
+}
+
+// Strings, numbers and lists of them as list of strings
+func schemaStrings(value interface{}) []string {
+  switch v := value.(type) {
+  case string:
+    return []string{v}
+  case float64:
+    return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+  case []interface{}:
+    list := []string{}
+    for _, item := range v {
+      list = append(list, schemaStrings(item)...)
+    }
+    return list
+  case map[string]interface{}:
+    if name := schemaText(v["name"]); name != "" {
+      return []string{name}
+    }
+  }
+  return []string{}
+}
+
+func schemaText(value interface{}) string {
+  list := schemaStrings(value)
+  if len(list) == 0 {
+    return ""
+  }
+  return cleanSchemaText(list[0])
+}
+
+// Sites often put HTML and entities into the texts
+func cleanSchemaText(text string) string {
+  text = html.UnescapeString(htmlTag.ReplaceAllString(text, " "))
+  return strings.Join(strings.Fields(text), " ")
+}
+
+// Parses ISO 8601 durations into seconds, nil if the text is no duration
+func ParseIsoDuration(text string) *int64 {
+  match := isoDuration.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(text)))
+  if match == nil {
+    return nil
+  }
+  factors := []float64{86400, 3600, 60, 1}
+  var seconds float64
+  found := false
+  for idx, factor := range factors {
+    if match[idx + 1] == "" {
+      continue
+    }
+    value, err := strconv.ParseFloat(match[idx + 1], 64)
+    if err != nil {
+      return nil
+    }
+    seconds += value * factor
+    found = true
+  }
+  if ! found {
+    return nil
+  }
+  result := int64(math.Round(seconds))
+  return &result
+}
+
+// Formats seconds as ISO 8601 duration like "PT1H30M"
+func FormatIsoDuration(seconds int64) string {
+  text := "PT"
+  if hours := seconds / 3600; hours > 0 {
+    text += strconv.FormatInt(hours, 10) + "H"
+  }
+  if minutes := seconds % 3600 / 60; minutes > 0 {
+    text += strconv.FormatInt(minutes, 10) + "M"
+  }
+  if rest := seconds % 60; rest > 0 || text == "PT" {
+    text += strconv.FormatInt(rest, 10) + "S"
+  }
+  return text
+}
+
+// The recipe as schema.org Recipe for JSON-LD output
+func (recipe *Recipe)SchemaOrg() map[string]interface{} {
+  node := map[string]interface{}{
+    "@context": "https://schema.org",
+    "@type": "Recipe",
+    "@id": "/recipes/" + strconv.FormatInt(recipe.ID, 10),
+    "identifier": recipe.ID,
+    "name": recipe.Title,
+    "description": recipe.Description,
+    "dateCreated": recipe.CreatedAt,
+    "dateModified": recipe.UpdatedAt,
+  }
+  if recipe.Servings > 0 {
+    node["recipeYield"] = strconv.Itoa(recipe.Servings)
+  }
+  times := map[string]*int64{
+    "prepTime": recipe.PrepTime,
+    "cookTime": recipe.CookTime,
+    "totalTime": recipe.TotalTime,
+  }
+  for key, duration := range times {
+    if duration != nil {
+      node[key] = FormatIsoDuration(*duration)
+    }
+  }
+
+  ingredients := []string{}
+  for _, ingredient := range recipe.Ingredients {
+    ingredients = append(ingredients, ingredient.Line())
+  }
+  node["recipeIngredient"] = ingredients
+
+  steps := []map[string]interface{}{}
+  for idx, step := range recipe.Steps {
+    howTo := map[string]interface{}{
+      "@type": "HowToStep",
+      "position": idx + 1,
+      "text": step.Text,
+    }
+    if step.Duration != nil {
+      howTo["performTime"] = FormatIsoDuration(*(step.Duration))
+    }
+    steps = append(steps, howTo)
+  }
+  node["recipeInstructions"] = steps
+
+  if len(recipe.Tags) > 0 {
+    node["keywords"] = strings.Join(recipe.Tags, ", ")
+  }
+  if len(recipe.Images) > 0 {
+    images := []string{}
+    for _, image := range recipe.Images {
+      images = append(images, image.URL)
+    }
+    node["image"] = images
+  }
+  return node
+}
+
+// A list of recipes as schema.org ItemList
+func SchemaOrgList(recipes []Recipe) map[string]interface{} {
+  items := []map[string]interface{}{}
+  for idx := range recipes {
+    item := recipes[idx].SchemaOrg()
+    delete(item, "@context")
+    items = append(items, map[string]interface{}{
+      "@type": "ListItem",
+      "position": idx + 1,
+      "item": item,
+    })
+  }
+  return map[string]interface{}{
+    "@context": "https://schema.org",
+    "@type": "ItemList",
+    "numberOfItems": len(items),
+    "itemListElement": items,
+  }
+}
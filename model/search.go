@@ -0,0 +1,143 @@
+package model
+
+import (
+  "database/sql"
+  "html"
+  "strings"
+)
+
+// Set by the schema setup when SQLite was built with FTS5
+// (go build -tags sqlite_fts5), otherwise search is unavailable
+var SearchEnabled = false
+
+// Marks matches in highlights, they are replaced after escaping the text
+const (
+  highlightStart = "\x02"
+  highlightEnd = "\x03"
+)
+
+var highlightMarkup = strings.NewReplacer(highlightStart, "<mark>", highlightEnd, "</mark>")
+
+// HTML, the recipe text is escaped and only the matches are wrapped in
+// <mark>
+type RecipeHighlight struct {
+  Title string `json:"title"`
+  Description string `json:"description"`
+  Ingredients string `json:"ingredients"`
+}
+
+type RecipeSearchResult struct {
+  Recipe
+  Rank float64 `json:"rank"`
+  Highlight RecipeHighlight `json:"highlight"`
+}
+
+type RecipeSearchPage struct {
+  List []RecipeSearchResult `json:"list"`
+  Limit int `json:"limit"`
+  Page int `json:"page"`
+  Total int `json:"total"`
+  Pages int `json:"pages"`
+  HasNext bool `json:"hasNext"`
+}
+
+// Turns free user input into a FTS5 query, every word has to match as
+// prefix. Returns an empty string if there is nothing to search for.
+func SearchQuery(text string) string {
+  var terms []string
+  for _, word := range strings.Fields(text) {
+    word = strings.Replace(word, "\"", "", -1)
+    if word == "" {
+      continue
+    }
+    terms = append(terms, "\"" + word + "\"*")
+  }
+  return strings.Join(terms, " ")
+}
+
+func SearchRecipes(tx *sql.Tx, query string, page, limit int) (*RecipeSearchPage, error) {
+
+  list := RecipeSearchPage{Limit: limit, Page: page, List: []RecipeSearchResult{}}
+
+  err := tx.QueryRow(
+    "SELECT COUNT(*) FROM `recipe_search` WHERE `recipe_search` MATCH ?", query).Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+  list.HasNext = page < list.Pages
+
+  rows, err := tx.Query(
+    "SELECT " + recipeColumns + ", `recipe_search`.`rank`, " +
+    "highlight(`recipe_search`, 0, char(2), char(3)), " +
+    "snippet(`recipe_search`, 1, char(2), char(3), '…', 16), " +
+    "snippet(`recipe_search`, 2, char(2), char(3), '…', 16) " +
+    "FROM `recipe_search` JOIN `recipe` ON `recipe`.`id` = `recipe_search`.`rowid` " +
+    "WHERE `recipe_search` MATCH ? ORDER BY `recipe_search`.`rank` LIMIT ?,?",
+    query, limit * (page - 1), limit)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    result := RecipeSearchResult{}
+    err = scanRecipe(rows, &(result.Recipe), &(result.Rank),
+      &(result.Highlight.Title), &(result.Highlight.Description), &(result.Highlight.Ingredients))
+    if err != nil {
+      return nil, err
+    }
+    result.Highlight.Title = highlightHtml(result.Highlight.Title)
+    result.Highlight.Description = highlightHtml(result.Highlight.Description)
+    result.Highlight.Ingredients = highlightHtml(result.Highlight.Ingredients)
+    list.List = append(list.List, result)
+  }
+  err = rows.Err()
+  if err != nil {
+    return nil, err
+  }
+  rows.Close()
+
+  recipes := make([]*Recipe, len(list.List))
+  for idx := range list.List {
+    recipes[idx] = &(list.List[idx].Recipe)
+  }
+  err = loadRelations(tx, recipes)
+  if err != nil {
+    return nil, err
+  }
+
+  return &list, nil
+}
+
+func highlightHtml(text string) string {
+  return highlightMarkup.Replace(html.EscapeString(text))
+}
+
+// The ingredients column of the index for a row of `recipe`, the schema
+// setup compares it with the index to find outdated entries
+const SearchIngredients = "COALESCE((SELECT group_concat(`name`, ', ') FROM " +
+  "(SELECT `name` FROM `ingredient` WHERE `ingredient`.`recipe` = `recipe`.`id` ORDER BY `id`)), '')"
+
+// Indexes the stored recipe, ingredients have to be saved before
+func (recipe *Recipe)index(tx *sql.Tx) error {
+  if ! SearchEnabled {
+    return nil
+  }
+  err := recipe.unindex(tx)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(
+    "INSERT INTO `recipe_search` (`rowid`, `title`, `description`, `ingredients`) " +
+    "SELECT `id`, `title`, `description`, " + SearchIngredients + " FROM `recipe` WHERE `id` = ?",
+    recipe.ID)
+  return err
+}
+
+func (recipe *Recipe)unindex(tx *sql.Tx) error {
+  if ! SearchEnabled {
+    return nil
+  }
+  _, err := tx.Exec("DELETE FROM `recipe_search` WHERE `rowid` = ?", recipe.ID)
+  return err
+}
@@ -0,0 +1,220 @@
+package model
+
+import (
+  "database/sql"
+  "strings"
+)
+
+// A preparation step, the order in Recipe.Steps is the cooking order.
+// Duration is in seconds, Ingredients references ingredient ids of the same
+// recipe. When saving, these are the ids sent with the ingredients, so new
+// ingredients can be referenced by a temporary id.
+type Step struct {
+  ID int64 `json:"id"`
+  Text string `json:"text"`
+  Duration *int64 `json:"duration"`
+  Ingredients []int64 `json:"ingredients"`
+  // Set by parsers, positions in Recipe.Ingredients of a recipe whose
+  // ingredients have no ids yet
+  ingredientRefs []int
+}
+
+func (step *Step)Validate() error {
+  if strings.TrimSpace(step.Text) == "" {
+    return ValidationError("step text can't be empty")
+  }
+  if step.Duration != nil && *(step.Duration) < 0 {
+    return ValidationError("step duration can't be negative")
+  }
+  return nil
+}
+
+func GetSteps(tx *sql.Tx, recipeId int64) ([]Step, error) {
+  steps, err := GetStepsForRecipes(tx, []int64{recipeId})
+  if err != nil {
+    return nil, err
+  }
+  return steps[recipeId], nil
+}
+
+// Loads the steps of many recipes with their ingredient references,
+// recipes without steps get an empty list
+func GetStepsForRecipes(tx *sql.Tx, recipeIds []int64) (map[int64][]Step, error) {
+  result := make(map[int64][]Step, len(recipeIds))
+  for _, id := range recipeIds {
+    result[id] = []Step{}
+  }
+
+  references := map[int64][]int64{}
+  err := forIdBatches(recipeIds, func(in string, args []interface{}) error {
+    rows, err := tx.Query(
+      "SELECT `step_ingredient`.`step`, `step_ingredient`.`ingredient` FROM `step_ingredient` " +
+      "JOIN `step` ON `step`.`id` = `step_ingredient`.`step` WHERE `step`.`recipe` IN " + in +
+      " ORDER BY `step_ingredient`.`ingredient`", args...)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var stepId, ingredientId int64
+      err = rows.Scan(&stepId, &ingredientId)
+      if err != nil {
+        return err
+      }
+      references[stepId] = append(references[stepId], ingredientId)
+    }
+    return rows.Err()
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  err = forIdBatches(recipeIds, func(in string, args []interface{}) error {
+    rows, err := tx.Query(
+      "SELECT `id`, `text`, `duration`, `recipe` FROM `step` WHERE `recipe` IN " + in +
+      " ORDER BY `recipe`, `position`", args...)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var recipeId int64
+      step := Step{}
+      err = rows.Scan(&(step.ID), &(step.Text), &(step.Duration), &recipeId)
+      if err != nil {
+        return err
+      }
+      step.Ingredients = references[step.ID]
+      if step.Ingredients == nil {
+        step.Ingredients = []int64{}
+      }
+      result[recipeId] = append(result[recipeId], step)
+    }
+    return rows.Err()
+  })
+  if err != nil {
+    return nil, err
+  }
+  return result, nil
+}
+
+func HasStepForRecipe(tx *sql.Tx, id, recipe int64) (bool, error) {
+  var count int
+  row := tx.QueryRow(
+    "SELECT COUNT(*) FROM `step` WHERE `id` = ? AND `recipe` = ?",
+    id, recipe)
+  err := row.Scan(&count)
+  return count == 1, err
+}
+
+func (step *Step)Create(tx *sql.Tx, recipe *Recipe, position int) error {
+  result, err := tx.Exec(
+    "INSERT INTO `step` (`text`, `duration`, `position`, `recipe`) VALUES (?,?,?,?)",
+    step.Text, step.Duration, position, recipe.ID)
+  if err != nil {
+    return err
+  }
+  step.ID, err = result.LastInsertId()
+  if err != nil {
+    return err
+  }
+  return step.saveIngredients(tx, recipe)
+}
+
+func (step *Step)Update(tx *sql.Tx, recipe *Recipe, position int) error {
+  _, err := tx.Exec(
+    "UPDATE `step` SET `text` = ?, `duration` = ?, `position` = ? WHERE `id` = ?",
+    step.Text, step.Duration, position, step.ID)
+  if err != nil {
+    return err
+  }
+  return step.saveIngredients(tx, recipe)
+}
+
+func (step *Step)Delete(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `step_ingredient` WHERE `step` = ?", step.ID)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec("DELETE FROM `step` WHERE `id` = ?", step.ID)
+  return err
+}
+
+// Turns the ingredient ids of the steps into positions in
+// Recipe.Ingredients before the ingredients are saved. New ingredients get
+// their id only then, so a step refers to them by the id the client sent
+// along with the ingredient.
+func (recipe *Recipe)refIngredientsByPosition() error {
+  positions := map[int64]int{}
+  for idx, ingredient := range recipe.Ingredients {
+    if _, ok := positions[ingredient.ID]; ! ok && ingredient.ID != 0 {
+      positions[ingredient.ID] = idx
+    }
+  }
+  for idx := range recipe.Steps {
+    step := &(recipe.Steps[idx])
+    if step.ingredientRefs != nil {
+      continue
+    }
+    step.ingredientRefs = []int{}
+    for _, id := range step.Ingredients {
+      position, ok := positions[id]
+      if ! ok {
+        return ValidationError("step references unknown ingredient")
+      }
+      step.ingredientRefs = append(step.ingredientRefs, position)
+    }
+  }
+  return nil
+}
+
+// Replaces the ingredient references, the ingredients of the recipe have to
+// be saved before
+func (step *Step)saveIngredients(tx *sql.Tx, recipe *Recipe) error {
+  _, err := tx.Exec("DELETE FROM `step_ingredient` WHERE `step` = ?", step.ID)
+  if err != nil {
+    return err
+  }
+  if step.ingredientRefs != nil {
+    step.Ingredients = []int64{}
+    for _, idx := range step.ingredientRefs {
+      if idx < 0 || idx >= len(recipe.Ingredients) {
+        continue
+      }
+      id := recipe.Ingredients[idx].ID
+      duplicate := false
+      for _, known := range step.Ingredients {
+        if known == id {
+          duplicate = true
+          break
+        }
+      }
+      if ! duplicate {
+        step.Ingredients = append(step.Ingredients, id)
+      }
+    }
+    step.ingredientRefs = nil
+  }
+  if step.Ingredients == nil {
+    step.Ingredients = []int64{}
+  }
+  for _, ingredientId := range step.Ingredients {
+    found := false
+    for _, ingredient := range recipe.Ingredients {
+      if ingredient.ID == ingredientId {
+        found = true
+        break
+      }
+    }
+    if ! found {
+      return ValidationError("step references unknown ingredient")
+    }
+    _, err = tx.Exec(
+      "INSERT OR IGNORE INTO `step_ingredient` (`step`, `ingredient`) VALUES (?,?)",
+      step.ID, ingredientId)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+  "database/sql"
+  "strings"
+)
+
+type TagCount struct {
+  Name string `json:"name"`
+  Count int `json:"count"`
+}
+
+// Tags are stored lower case without surrounding space
+func NormalizeTag(name string) string {
+  return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func ValidateTag(name string) error {
+  if name == "" {
+    return ValidationError("tag can't be empty")
+  }
+  if len(name) > 64 {
+    return ValidationError("tag too long: " + name)
+  }
+  return nil
+}
+
+// All tags in use with the number of recipes, most used first. Recipes in
+// the trash don't count.
+func GetTags(tx *sql.Tx) ([]TagCount, error) {
+  list := []TagCount{}
+  rows, err := tx.Query(
+    "SELECT `tag`.`name`, COUNT(*) AS `count` FROM `tag` " +
+    "JOIN `recipe_tag` ON `recipe_tag`.`tag` = `tag`.`id` " +
+    "JOIN `recipe` ON `recipe`.`id` = `recipe_tag`.`recipe` WHERE " + recipeLive +
+    " GROUP BY `tag`.`id` ORDER BY `count` DESC, `tag`.`name`")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    tag := TagCount{}
+    err = rows.Scan(&(tag.Name), &(tag.Count))
+    if err != nil {
+      return nil, err
+    }
+    list = append(list, tag)
+  }
+  err = rows.Err()
+  if err != nil {
+    return nil, err
+  }
+  return list, nil
+}
+
+// Loads the tag names of many recipes, recipes without tags get an
+// empty list
+func GetTagsForRecipes(tx *sql.Tx, recipeIds []int64) (map[int64][]string, error) {
+  result := make(map[int64][]string, len(recipeIds))
+  for _, id := range recipeIds {
+    result[id] = []string{}
+  }
+
+  err := forIdBatches(recipeIds, func(in string, args []interface{}) error {
+    rows, err := tx.Query(
+      "SELECT `recipe_tag`.`recipe`, `tag`.`name` FROM `recipe_tag` " +
+      "JOIN `tag` ON `tag`.`id` = `recipe_tag`.`tag` WHERE `recipe_tag`.`recipe` IN " + in +
+      " ORDER BY `tag`.`name`", args...)
+    if err != nil {
+      return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var recipeId int64
+      var name string
+      err = rows.Scan(&recipeId, &name)
+      if err != nil {
+        return err
+      }
+      result[recipeId] = append(result[recipeId], name)
+    }
+    return rows.Err()
+  })
+  if err != nil {
+    return nil, err
+  }
+  return result, nil
+}
+
+// Replaces the tags of the recipe, creates missing tags and removes tags
+// no recipe uses anymore
+func (recipe *Recipe)saveTags(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `recipe_tag` WHERE `recipe` = ?", recipe.ID)
+  if err != nil {
+    return err
+  }
+
+  tags := []string{}
+  for _, name := range recipe.Tags {
+    name = NormalizeTag(name)
+    duplicate := false
+    for _, tag := range tags {
+      if tag == name {
+        duplicate = true
+        break
+      }
+    }
+    if duplicate {
+      continue
+    }
+    tags = append(tags, name)
+
+    _, err = tx.Exec("INSERT OR IGNORE INTO `tag` (`name`) VALUES (?)", name)
+    if err != nil {
+      return err
+    }
+    _, err = tx.Exec(
+      "INSERT INTO `recipe_tag` (`recipe`, `tag`) SELECT ?, `id` FROM `tag` WHERE `name` = ?",
+      recipe.ID, name)
+    if err != nil {
+      return err
+    }
+  }
+  recipe.Tags = tags
+  return deleteUnusedTags(tx)
+}
+
+func deleteUnusedTags(tx *sql.Tx) error {
+  _, err := tx.Exec("DELETE FROM `tag` WHERE `id` NOT IN (SELECT `tag` FROM `recipe_tag`)")
+  return err
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+  "database/sql"
+  "time"
+)
+
+const RevisionTrash = "trash"
+
+// Moves the recipe to the trash, UpdatedBy has to be set to the user
+// deleting it. Returns ErrVersionConflict if the stored version isn't the
+// one of the recipe.
+func (recipe *Recipe)Trash(tx *sql.Tx) error {
+  now := time.Now().UTC()
+  result, err := tx.Exec("UPDATE `recipe` SET `deleted_at` = ?, `deleted_by` = ?, `version` = `version` + 1 WHERE `id` = ? AND `version` = ?",
+    now, recipe.UpdatedBy, recipe.ID, recipe.Version)
+  if err != nil {
+    return err
+  }
+  changed, err := result.RowsAffected()
+  if err != nil {
+    return err
+  }
+  if changed == 0 {
+    return ErrVersionConflict
+  }
+  recipe.Version++
+  recipe.DeletedAt = &now
+  recipe.DeletedBy = &(recipe.UpdatedBy)
+  err = recipe.unindex(tx)
+  if err != nil {
+    return err
+  }
+  return recipe.saveRevision(tx, RevisionTrash)
+}
+
+// Takes the recipe out of the trash, UpdatedBy has to be set to the user
+// restoring it
+func (recipe *Recipe)Untrash(tx *sql.Tx) error {
+  err := recipe.clearTrash(tx)
+  if err != nil {
+    return err
+  }
+  err = recipe.index(tx)
+  if err != nil {
+    return err
+  }
+  return recipe.saveRevision(tx, RevisionRestore)
+}
+
+func (recipe *Recipe)clearTrash(tx *sql.Tx) error {
+  _, err := tx.Exec("UPDATE `recipe` SET `deleted_at` = NULL, `deleted_by` = NULL, `version` = `version` + 1 WHERE `id` = ?", recipe.ID)
+  if err != nil {
+    return err
+  }
+  recipe.Version++
+  recipe.DeletedAt = nil
+  recipe.DeletedBy = nil
+  return nil
+}
+
+func GetTrashedRecipe(tx *sql.Tx, id int64) (*Recipe, error) {
+  recipe := &Recipe{}
+  row := tx.QueryRow("SELECT " + recipeColumns + " FROM `recipe` WHERE `id` = ? AND `deleted_at` IS NOT NULL", id)
+  err := scanRecipe(row, recipe)
+  if err != nil {
+    return nil, err
+  }
+  err = loadRelations(tx, []*Recipe{recipe})
+  if err != nil {
+    return nil, err
+  }
+  return recipe, nil
+}
+
+// Recipes in the trash, last deleted first. A creator other than 0 only
+// lists the recipes of that user.
+func GetTrashPage(tx *sql.Tx, page, limit int, createdBy int64) (*RecipeListPage, error) {
+  list := RecipeListPage{Limit: limit, Page: page}
+
+  conditions := []string{"`recipe`.`deleted_at` IS NOT NULL"}
+  var args []interface{}
+  if createdBy != 0 {
+    conditions = append(conditions, "`recipe`.`created_by` = ?")
+    args = append(args, createdBy)
+  }
+  where := whereClause(conditions)
+
+  err := tx.QueryRow("SELECT COUNT(*) FROM `recipe`" + where, args...).Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+  list.HasNext = page < list.Pages
+
+  args = append(args, limit * (page - 1), limit)
+  list.List, err = queryRecipes(tx,
+    "SELECT " + recipeColumns + " FROM `recipe`" + where +
+    " ORDER BY `recipe`.`deleted_at` DESC, `recipe`.`id` DESC LIMIT ?,?", args...)
+  if err != nil {
+    return nil, err
+  }
+  return &list, nil
+}
+
+// Recipes deleted before the given time, at most idBatchSize
+func GetExpiredTrash(tx *sql.Tx, before time.Time) ([]Recipe, error) {
+  return queryRecipes(tx,
+    "SELECT " + recipeColumns + " FROM `recipe` WHERE `recipe`.`deleted_at` < ? " +
+    "ORDER BY `recipe`.`deleted_at` LIMIT ?", before, idBatchSize)
+}
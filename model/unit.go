@@ -0,0 +1,138 @@
+package model
+
+import (
+  "math"
+  "strings"
+)
+
+const (
+  DimensionMass = "mass"
+  DimensionVolume = "volume"
+  DimensionCount = "count"
+)
+
+const (
+  SystemMetric = "metric"
+  SystemImperial = "imperial"
+)
+
+// Factor converts one of the unit into the base unit of the dimension,
+// gram for mass and milliliter for volume. Count units have no base unit
+// and only convert to themselves. Step is the precision amounts are rounded
+// to, units without step are rounded to significant digits.
+type Unit struct {
+  Name string `json:"name"`
+  Dimension string `json:"dimension"`
+  System string `json:"system,omitempty"`
+  Factor float64 `json:"factor"`
+  Step float64 `json:"step,omitempty"`
+  aliases []string
+}
+
+var units = []Unit{
+  {Name: "mg", Dimension: DimensionMass, System: SystemMetric, Factor: 0.001,
+    aliases: []string{"milligram", "milligrams"}},
+  {Name: "g", Dimension: DimensionMass, System: SystemMetric, Factor: 1,
+    aliases: []string{"gr", "gram", "grams", "gramm"}},
+  {Name: "kg", Dimension: DimensionMass, System: SystemMetric, Factor: 1000,
+    aliases: []string{"kilo", "kilos", "kilogram", "kilograms", "kilogramm"}},
+  {Name: "oz", Dimension: DimensionMass, System: SystemImperial, Factor: 28.349523125, Step: 0.25,
+    aliases: []string{"ounce", "ounces"}},
+  {Name: "lb", Dimension: DimensionMass, System: SystemImperial, Factor: 453.59237, Step: 0.25,
+    aliases: []string{"lbs", "pound", "pounds"}},
+  {Name: "ml", Dimension: DimensionVolume, System: SystemMetric, Factor: 1,
+    aliases: []string{"milliliter", "milliliters", "millilitre", "millilitres"}},
+  {Name: "cl", Dimension: DimensionVolume, System: SystemMetric, Factor: 10,
+    aliases: []string{"centiliter", "centiliters", "centilitre", "centilitres"}},
+  {Name: "dl", Dimension: DimensionVolume, System: SystemMetric, Factor: 100,
+    aliases: []string{"deciliter", "deciliters", "decilitre", "decilitres"}},
+  {Name: "l", Dimension: DimensionVolume, System: SystemMetric, Factor: 1000,
+    aliases: []string{"liter", "liters", "litre", "litres"}},
+  {Name: "tsp", Dimension: DimensionVolume, Factor: 4.92892159375, Step: 0.125,
+    aliases: []string{"teaspoon", "teaspoons", "tl", "teelöffel"}},
+  {Name: "tbsp", Dimension: DimensionVolume, Factor: 14.78676478125, Step: 0.25,
+    aliases: []string{"tbs", "tablespoon", "tablespoons", "el", "esslöffel"}},
+  {Name: "fl oz", Dimension: DimensionVolume, System: SystemImperial, Factor: 29.5735295625, Step: 0.5,
+    aliases: []string{"fl. oz", "fluid ounce", "fluid ounces"}},
+  {Name: "cup", Dimension: DimensionVolume, System: SystemImperial, Factor: 236.5882365, Step: 0.25,
+    aliases: []string{"cups", "c"}},
+  {Name: "pt", Dimension: DimensionVolume, System: SystemImperial, Factor: 473.176473, Step: 0.25,
+    aliases: []string{"pint", "pints"}},
+  {Name: "qt", Dimension: DimensionVolume, System: SystemImperial, Factor: 946.352946, Step: 0.25,
+    aliases: []string{"quart", "quarts"}},
+  {Name: "gal", Dimension: DimensionVolume, System: SystemImperial, Factor: 3785.411784, Step: 0.25,
+    aliases: []string{"gallon", "gallons"}},
+  {Name: "pinch", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"pinches", "prise"}},
+  {Name: "piece", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"pieces", "pc", "pcs", "stück"}},
+  {Name: "clove", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"cloves"}},
+  {Name: "slice", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"slices"}},
+  {Name: "can", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"cans", "tin", "tins"}},
+  {Name: "bunch", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"bunches"}},
+  {Name: "handful", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"handfuls"}},
+  {Name: "package", Dimension: DimensionCount, Factor: 1, Step: 1,
+    aliases: []string{"packages", "pkg", "pack", "packs"}},
+}
+
+var unitsByAlias = map[string]*Unit{}
+
+func init() {
+  for idx := range units {
+    unit := &units[idx]
+    unitsByAlias[unit.Name] = unit
+    for _, alias := range unit.aliases {
+      unitsByAlias[alias] = unit
+    }
+  }
+}
+
+// Finds a unit by name or alias, case and a trailing dot are ignored
+func LookupUnit(name string) (*Unit, bool) {
+  name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+  unit, ok := unitsByAlias[strings.Join(strings.Fields(name), " ")]
+  return unit, ok
+}
+
+func Units() []Unit {
+  return units
+}
+
+// Rounds to the step of the unit. Amounts without unit count pieces and
+// are rounded like the count units, at least to half a piece.
+func RoundAmount(amount float64, unitName string) float64 {
+  step := 0.5
+  if unit, ok := LookupUnit(unitName); ok {
+    step = unit.Step
+  } else if unitName != "" {
+    step = 0
+  }
+  if step == 0 {
+    return roundSignificant(amount)
+  }
+  rounded := math.Round(amount / step) * step
+  if rounded == 0 && amount > 0 {
+    return step
+  }
+  return rounded
+}
+
+// Two significant digits below 10, whole numbers above and steps of 5
+// from 1000 on
+func roundSignificant(amount float64) float64 {
+  switch {
+  case amount >= 1000:
+    return math.Round(amount / 5) * 5
+  case amount >= 10:
+    return math.Round(amount)
+  case amount > 0:
+    magnitude := math.Pow(10, math.Floor(math.Log10(amount)) - 1)
+    return math.Round(amount / magnitude) * magnitude
+  }
+  return amount
+}
@@ -2,20 +2,47 @@ package model
 
 import (
   "database/sql"
+  "time"
   "golang.org/x/crypto/bcrypt"
 )
 
+const (
+  RoleAdmin = "admin"
+  RoleEditor = "editor"
+  RoleViewer = "viewer"
+)
+
+// Higher roles include all rights of the lower ones
+var roleLevels = map[string]int{
+  RoleViewer: 1,
+  RoleEditor: 2,
+  RoleAdmin: 3,
+}
+
+func ValidRole(role string) bool {
+  _, ok := roleLevels[role]
+  return ok
+}
+
 type User struct {
   ID int64 `json:"id"`
   Name string `json:"name"`
   Enabled bool `json:"enabled"`
+  Role string `json:"role"`
+  // Counts up with every change, used as ETag
+  Version int `json:"version"`
   password string `json:"-"`
 }
 
 type UserListPage struct {
   List []User `json:"list"`
   Limit int `json:"limit"`
-  Page int `json:"page"`
+  Page int `json:"page,omitempty"`
+  Cursor string `json:"cursor,omitempty"`
+  Total int `json:"total"`
+  Pages int `json:"pages"`
+  HasNext bool `json:"hasNext"`
+  NextCursor string `json:"nextCursor,omitempty"`
 }
 
 func (u *User) SetPassword(passwd string) bool {
@@ -39,64 +66,150 @@ func (u *User) GetPasswordHash() string {
   return u.password
 }
 
+func (u *User) IsAdmin() bool {
+  return u.Role == RoleAdmin
+}
+
+func (u *User) HasRole(role string) bool {
+  return ValidRole(role) && roleLevels[u.Role] >= roleLevels[role]
+}
+
 func (user *User) Create(tx *sql.Tx) error {
   result, err := tx.Exec(
-    "INSERT INTO `user` (`name`, `enabled`, `password`) VALUES (?, ?, ?)",
-    user.Name, user.Enabled, user.password)
+    "INSERT INTO `user` (`name`, `enabled`, `role`, `password`) VALUES (?, ?, ?, ?)",
+    user.Name, user.Enabled, user.Role, user.password)
   if err != nil {
     return err
   }
   user.ID, err = result.LastInsertId()
+  user.Version = 1
   return nil
 }
 
 func (user *User) Delete(tx *sql.Tx) error {
-  _, err := tx.Exec("DELETE FROM `user` WHERE `id` = ?", user.ID)
+  _, err := tx.Exec("DELETE FROM `refresh_token` WHERE `user` = ?", user.ID)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec("DELETE FROM `user` WHERE `id` = ?", user.ID)
+  return err
+}
+
+// Revokes every access and refresh token issued to the user so far
+func (user *User) RevokeTokens(tx *sql.Tx) error {
+  now := time.Now().UTC()
+  _, err := tx.Exec("UPDATE `user` SET `tokens_revoked_at` = ? WHERE `id` = ?", now, user.ID)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec("UPDATE `refresh_token` SET `revoked_at` = ? WHERE `user` = ? AND `revoked_at` IS NULL", now, user.ID)
   return err
 }
 
 func GetUser(tx *sql.Tx, id int64) (*User, error) {
   user := &User{}
-  row := tx.QueryRow("SELECT `id`, `name`, `enabled`, `password` FROM `user` WHERE `id` = ?", id)
-  err := row.Scan(&(user.ID), &(user.Name), &(user.Enabled), &(user.password))
+  row := tx.QueryRow("SELECT `id`, `name`, `enabled`, `role`, `version`, `password` FROM `user` WHERE `id` = ?", id)
+  err := row.Scan(&(user.ID), &(user.Name), &(user.Enabled), &(user.Role), &(user.Version), &(user.password))
   return user, err
 }
 
 func GetUserByName(tx *sql.Tx, name string) (*User, error) {
   user := &User{}
-  row := tx.QueryRow("SELECT `id`, `name`, `enabled`, `password` FROM `user` WHERE `name` = ?", name)
-  err := row.Scan(&(user.ID), &(user.Name), &(user.Enabled), &(user.password))
+  row := tx.QueryRow("SELECT `id`, `name`, `enabled`, `role`, `version`, `password` FROM `user` WHERE `name` = ?", name)
+  err := row.Scan(&(user.ID), &(user.Name), &(user.Enabled), &(user.Role), &(user.Version), &(user.password))
   return user, err
 }
 
+// Version has to be the stored version the change is based on, otherwise
+// ErrVersionConflict is returned
 func (user *User)Update(tx *sql.Tx) error {
-  _, err := tx.Exec(
-    "UPDATE `user` SET `name` = ?, `password` = ?, `enabled` = ? WHERE `id` = ?",
-    user.Name, user.password, user.Enabled, user.ID)
-  return err
+  result, err := tx.Exec(
+    "UPDATE `user` SET `name` = ?, `password` = ?, `enabled` = ?, `role` = ?, `version` = `version` + 1 WHERE `id` = ? AND `version` = ?",
+    user.Name, user.password, user.Enabled, user.Role, user.ID, user.Version)
+  if err != nil {
+    return err
+  }
+  changed, err := result.RowsAffected()
+  if err != nil {
+    return err
+  }
+  if changed == 0 {
+    return ErrVersionConflict
+  }
+  user.Version++
+  return nil
 }
 
 func GetUserPage(tx *sql.Tx, page, limit int) (*UserListPage, error) {
 
-  list := UserListPage{Limit: limit, Page: page, List: []User{}}
+  list := UserListPage{Limit: limit, Page: page}
 
-  rows, err := tx.Query("SELECT `id`, `name`, `enabled` FROM `user` LIMIT ?,?", limit * (page - 1), limit)
+  err := tx.QueryRow("SELECT COUNT(*) FROM `user`").Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+  list.HasNext = page < list.Pages
+
+  list.List, err = queryUsers(tx,
+    "SELECT `id`, `name`, `enabled`, `role`, `version` FROM `user` ORDER BY `id` LIMIT ?,?", limit * (page - 1), limit)
+  if err != nil {
+    return nil, err
+  }
+  return &list, nil
+}
+
+// Keyset paging on the user id, an empty cursor starts at the beginning
+func GetUserCursor(tx *sql.Tx, cursor string, limit int) (*UserListPage, error) {
+
+  list := UserListPage{Limit: limit, Cursor: cursor}
+
+  err := tx.QueryRow("SELECT COUNT(*) FROM `user`").Scan(&(list.Total))
+  if err != nil {
+    return nil, err
+  }
+  list.Pages = pageCount(list.Total, limit)
+
+  var after int64
+  if cursor != "" {
+    after, err = decodeCursor(cursor, false)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  // One more row than needed tells if there is a next page
+  list.List, err = queryUsers(tx,
+    "SELECT `id`, `name`, `enabled`, `role`, `version` FROM `user` WHERE `id` > ? ORDER BY `id` LIMIT ?", after, limit + 1)
+  if err != nil {
+    return nil, err
+  }
+  if len(list.List) > limit {
+    list.List = list.List[:limit]
+    list.HasNext = true
+    list.NextCursor = encodeCursor(list.List[limit - 1].ID, false)
+  }
+  return &list, nil
+}
+
+func queryUsers(tx *sql.Tx, query string, args ...interface{}) ([]User, error) {
+  list := []User{}
+  rows, err := tx.Query(query, args...)
   if err != nil {
     return nil, err
   }
   defer rows.Close()
   for rows.Next() {
     user := User{}
-    err = rows.Scan(&(user.ID), &(user.Name), &(user.Enabled))
+    err = rows.Scan(&(user.ID), &(user.Name), &(user.Enabled), &(user.Role), &(user.Version))
     if err != nil {
       return nil, err
     }
-    list.List = append(list.List, user)
+    list = append(list, user)
   }
   err = rows.Err()
   if err != nil {
     return nil, err
   }
-
-  return &list, nil
+  return list, nil
 }